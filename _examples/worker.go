@@ -20,14 +20,18 @@ func main() {
 		Region: aws.String("us-east-1"),
 	})
 
-	leaser := lease.New(&lease.Config{
+	leaser, err := lease.NewLeaser(&lease.Config{
 		Logger:     log,
 		Client:     dynamodb.New(sess),
 		LeaseTable: "lease-table-test",
 	})
 
+	if err != nil {
+		log.WithError(err).Fatal("invalid config")
+	}
+
 	// start taking leases
-	err := leaser.Start()
+	err = leaser.Start()
 
 	if err != nil {
 		log.WithError(err).Fatal("start leaser")
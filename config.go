@@ -3,6 +3,7 @@ package lease
 import (
 	"crypto/rand"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,7 +39,6 @@ type Logger interface {
 	Debug(...interface{})
 	Info(...interface{})
 	Error(...interface{})
-	Fatal(...interface{})
 	Debugf(string, ...interface{})
 	Infof(string, ...interface{})
 	Warnf(string, ...interface{})
@@ -52,28 +52,133 @@ type Config struct {
 	// Logger is the logger used. defaults to log.Log
 	Logger Logger
 
-	// Backoff determines the backoff strategy for http failures.
-	// Defaults to lease.Backoff with min value of time.Second and jitter
-	// set to true.
+	// BackoffFactory creates the backoff strategy for http failures of each call, so
+	// concurrent calls(e.g: of the Taker, the Renewer and the application) do not share
+	// their retry state. Defaults to a factory of lease.Backoff with min value of
+	// time.Second, max value of 10s and jitter set to true.
+	BackoffFactory func() Backofface
+
+	// Backoff determines the backoff strategy for http failures. If it's set(and
+	// BackoffFactory is not), it's shared by all the calls.
+	//
+	// Deprecated: use BackoffFactory.
 	Backoff Backofface
 
+	// Strategy determines which leases the Taker takes or steals in each cycle.
+	// Defaults to lease.BalancedStrategy. use lease.RendezvousStrategy to keep
+	// leases on the same workers across scale events.
+	Strategy Strategy
+
 	// The Amazon DynamoDB table name used for tracking leases.
 	LeaseTable string
 
+	// The Amazon DynamoDB table name used for tracking workers heartbeats.
+	// Defaults to LeaseTable with a "-workers" suffix.
+	WorkerTable string
+
 	// WorkerId used as a lease-owner.
 	WorkerId string
 
+	// Labels describe the worker properties(e.g: region, tenant or zone).
+	// The worker takes only leases whose requirements match its labels.
+	Labels map[string]string
+
+	// Zone is the availability zone of the worker. When workers declare zones,
+	// the Taker prefers to steal leases from workers in zones that hold more
+	// than their share of leases.
+	Zone string
+
 	// ExpireAfter indicate how long lease unit can live without renovation
 	// before expiration.
 	// A worker which does not renew it's lease, will be regarded as having problems
 	// and it's shards will be assigned to other workers. defaults to 10s.
+	// It can be extended per lease using Lease.ExpireAfter.
 	ExpireAfter time.Duration
 
+	// TakerInterval is the interval between two runs of the Taker.
+	// defaults to (ExpireAfter + epsilon) * 2.
+	TakerInterval time.Duration
+
+	// RenewerInterval is the interval between two runs of the Renewer. The worker
+	// heartbeat is sent in the same interval. It must be less than ExpireAfter/2, so
+	// each lease is renewed at least twice before it expires. defaults to ExpireAfter/3 - epsilon.
+	RenewerInterval time.Duration
+
+	// Jitter is the fraction(in range [0, 1)) of TakerInterval and RenewerInterval
+	// that is randomly cut from each interval, so a fleet that was started together
+	// does not scan the table in lockstep. defaults to 0.
+	Jitter float64
+
+	// WallClockExpiry enables the wall-clock expiry mode. In this mode, the renewal time
+	// is written on each renewal, and the Taker judges the expiry of leases it sees for
+	// the first time by this time, instead of watching them for ExpireAfter. It allows a
+	// freshly started worker to take dead leases immediately, but it relies on the clocks
+	// of the workers to be synchronized up to MaxClockSkew. defaults to false.
+	WallClockExpiry bool
+
+	// MaxClockSkew is the maximum difference between the clocks of the workers that is
+	// tolerated in wall-clock expiry mode. defaults to 1s.
+	MaxClockSkew time.Duration
+
 	// Max leases to steal from another worker at one time (for load balancing).
 	// Setting this to a higher number allow faster load convergence (e.g. during deployments, cold starts),
 	// but can cause higher churn in the system. defaults to 1.
 	MaxLeasesToStealAtOneTime int
 
+	// MinHoldDuration is the minimum time a worker holds a lease before other workers
+	// can steal it. The ownership time is observed by the Taker of each worker, so a
+	// worker that just started doesn't steal for this duration. defaults to 0.
+	MinHoldDuration time.Duration
+
+	// MaxHoldDuration is the maximum time a worker holds a lease before the Renewer
+	// releases it, to let the Taker of another worker take it(e.g: to spread wear).
+	// It can be overridden per lease using Lease.MaxHoldDuration. defaults to 0(unlimited).
+	MaxHoldDuration time.Duration
+
+	// StealCooldown is the minimum time between two steals of the same lease.
+	// defaults to 0.
+	StealCooldown time.Duration
+
+	// StealHysteresis is the difference between the number of leases of another
+	// worker and ours, that we tolerate before stealing from it. Setting this to 1
+	// or more prevents leases to ping-pong between workers when the number of leases
+	// doesn't divide evenly. defaults to 0.
+	StealHysteresis int
+
+	// MaxStealPriority is the maximum priority of a lease that can be stolen to
+	// satisfy balance. leases with higher priority are never stolen. defaults to 0,
+	// so only leases with the default(or lower) priority are stolen.
+	MaxStealPriority int
+
+	// StealBudget is the maximum number of leases the whole fleet can steal in each
+	// StealBudgetWindow. The budget is coordinated through the lease table, and it's
+	// checked by the Taker before stealing. defaults to 0(unlimited).
+	StealBudget int
+
+	// StealBudgetWindow is the time window of the StealBudget. defaults to 1m.
+	StealBudgetWindow time.Duration
+
+	// HandoffTimeout enables the cooperative handoff of stolen leases. If set, the Taker
+	// asks the owner of a lease it wants to steal to hand it off, and the Renewer of the
+	// owner hands it off on its next run. The lease is taken forcefully only if it was
+	// not handed off within HandoffTimeout. defaults to 0, so leases are stolen immediately.
+	HandoffTimeout time.Duration
+
+	// OnHandoff is called by the Renewer before it hands off a held lease to the worker
+	// that asked for it, or releases it after its MaxHoldDuration(or after it was rescheduled). Use it to stop
+	// processing the lease, and to checkpoint it. It's called after the held leases were renewed,
+	// but it delays the next run of the Renewer, so it should return well within RenewerInterval.
+	// Handoffs to workers that did not send a heartbeat within ExpireAfter are canceled.
+	OnHandoff func(Lease)
+
+	// CompletedRetention is how long completed leases are kept in the lease table
+	// before the Taker deletes them. defaults to 0, so completed leases are never deleted.
+	CompletedRetention time.Duration
+
+	// RetryPolicies determines how each of the DynamoDB operations is retried.
+	// The unset fields of each policy are set to their defaults.
+	RetryPolicies RetryPolicies
+
 	// The Amazon DynamoDB table used for tracking leases will be provisioned with this read capacity.
 	// Defaults to 10.
 	LeaseTableReadCap int
@@ -86,7 +191,8 @@ type Config struct {
 	epsilonMills time.Duration
 }
 
-// defaults for configuration.
+// defaults for configuration. it's called once by NewLeaser, and the config is
+// validated by Validate.
 func (c *Config) defaults() {
 	if c.Logger == nil {
 		c.Logger = logrus.New()
@@ -97,16 +203,41 @@ func (c *Config) defaults() {
 		c.Client = dynamodb.New(session.New(aws.NewConfig()))
 	}
 
-	if c.Backoff == nil {
-		c.Backoff = &Backoff{
-			b: &backoff.Backoff{
-				Min:    time.Second,
-				Jitter: true,
-			}}
+	if c.WorkerId == "" {
+		// an empty WorkerId is reported by NewLeaser.
+		if wid, err := uuid(); err == nil {
+			c.Logger.Infof("WorkerId does not provided in config. WorkerId is automatically assigned as: %s", wid)
+			c.WorkerId = wid
+		}
+	}
+
+	c.defaultValues()
+}
+
+// defaultValues sets the default values of the unset fields that do not depend on
+// the environment(i.e: all fields, except the Logger, the Client and the WorkerId).
+func (c *Config) defaultValues() {
+	if c.BackoffFactory == nil {
+		if b := c.Backoff; b != nil {
+			c.BackoffFactory = func() Backofface { return b }
+		} else {
+			c.BackoffFactory = func() Backofface {
+				return &Backoff{
+					b: &backoff.Backoff{
+						Min:    time.Second,
+						Max:    10 * time.Second,
+						Jitter: true,
+					}}
+			}
+		}
+	}
+
+	if c.Strategy == nil {
+		c.Strategy = &BalancedStrategy{}
 	}
 
-	if c.LeaseTable == "" {
-		c.Logger.Fatal("LeaseTable is required field")
+	if c.WorkerTable == "" && c.LeaseTable != "" {
+		c.WorkerTable = c.LeaseTable + "-workers"
 	}
 
 	c.epsilonMills = time.Millisecond * 25
@@ -114,39 +245,103 @@ func (c *Config) defaults() {
 	if c.ExpireAfter == 0 {
 		c.ExpireAfter = time.Second * 10
 	}
-	if c.ExpireAfter < time.Second*10 {
-		c.Logger.Fatal("ExpireAfter must be greater or equal to 10s")
+
+	if c.TakerInterval == 0 {
+		c.TakerInterval = (c.ExpireAfter + c.epsilonMills) * 2
+	}
+
+	if c.RenewerInterval == 0 {
+		c.RenewerInterval = c.ExpireAfter/3 - c.epsilonMills
+	}
+
+	c.RetryPolicies.defaults(c)
+
+	if c.MaxClockSkew == 0 {
+		c.MaxClockSkew = time.Second
 	}
 
 	if c.MaxLeasesToStealAtOneTime == 0 {
 		c.MaxLeasesToStealAtOneTime = 1
 	}
-	if c.MaxLeasesToStealAtOneTime < 0 {
-		c.Logger.Fatal("MaxLeasesToStealAtOneTime should be greater than 0")
+
+	if c.StealBudgetWindow == 0 {
+		c.StealBudgetWindow = time.Minute
 	}
 
 	if c.LeaseTableReadCap == 0 {
 		c.LeaseTableReadCap = 10
 	}
-	if c.LeaseTableReadCap < 0 {
-		c.Logger.Fatal("LeaseTableReadCap must be greater than 0")
-	}
 
 	if c.LeaseTableWriteCap == 0 {
 		c.LeaseTableWriteCap = 10
 	}
-	if c.LeaseTableWriteCap < 0 {
-		c.Logger.Fatal("LeaseTableWriteCap must be greater than 0")
+}
+
+// ValidationError describes an invalid Config field.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("leaser: invalid config field %s: %s", e.Field, e.Reason)
+}
+
+// ValidationErrors holds the errors of all the invalid Config fields.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "; ")
+}
 
-	if c.WorkerId == "" {
-		wid, err := uuid()
-		if err != nil {
-			c.Logger.Fatal("Failed to generate uuid. WorkerId is required field")
+// Validate validates the config as if its unset fields were set to their defaults,
+// without changing it. It returns ValidationErrors with an entry for each invalid
+// field, or nil if the config is valid.
+func (c *Config) Validate() error {
+	d := *c
+	d.defaultValues()
+
+	var errs ValidationErrors
+	check := func(ok bool, field, reason string) {
+		if !ok {
+			errs = append(errs, &ValidationError{Field: field, Reason: reason})
 		}
-		c.Logger.Infof("WorkerId does not provided in config. WorkerId is automatically assigned as: %s", wid)
-		c.WorkerId = wid
 	}
+	check(d.LeaseTable != "", "LeaseTable", "is required field")
+	check(d.ExpireAfter >= time.Second*10, "ExpireAfter", "must be greater or equal to 10s")
+	check(d.TakerInterval > 0, "TakerInterval", "must be greater than 0")
+	check(d.RenewerInterval > 0 && d.RenewerInterval < d.ExpireAfter/2, "RenewerInterval", "must be greater than 0 and less than ExpireAfter/2")
+	check(d.Jitter >= 0 && d.Jitter < 1, "Jitter", "must be greater or equal to 0 and less than 1")
+	check(d.MaxClockSkew > 0 && d.MaxClockSkew < d.ExpireAfter, "MaxClockSkew", "must be greater than 0 and less than ExpireAfter")
+	check(d.MaxLeasesToStealAtOneTime > 0, "MaxLeasesToStealAtOneTime", "must be greater than 0")
+	check(d.MinHoldDuration >= 0, "MinHoldDuration", "must be greater or equal to 0")
+	check(d.MaxHoldDuration >= 0, "MaxHoldDuration", "must be greater or equal to 0")
+	check(d.StealCooldown >= 0, "StealCooldown", "must be greater or equal to 0")
+	check(d.StealHysteresis >= 0, "StealHysteresis", "must be greater or equal to 0")
+	check(d.StealBudget >= 0, "StealBudget", "must be greater or equal to 0")
+	check(d.StealBudgetWindow > 0, "StealBudgetWindow", "must be greater than 0")
+	check(d.HandoffTimeout >= 0, "HandoffTimeout", "must be greater or equal to 0")
+	check(d.CompletedRetention >= 0, "CompletedRetention", "must be greater or equal to 0")
+	check(d.LeaseTableReadCap > 0, "LeaseTableReadCap", "must be greater than 0")
+	check(d.LeaseTableWriteCap > 0, "LeaseTableWriteCap", "must be greater than 0")
+
+	names, policies := d.RetryPolicies.policies()
+	for i, p := range policies {
+		name := names[i]
+		check(p.MaxAttempts > 0, "RetryPolicies."+name+".MaxAttempts", "must be greater than 0")
+		check(p.MaxThrottledAttempts > 0, "RetryPolicies."+name+".MaxThrottledAttempts", "must be greater than 0")
+		check(p.MaxElapsedTime > 0, "RetryPolicies."+name+".MaxElapsedTime", "must be greater than 0")
+		check(p.MaxThrottledElapsedTime > 0, "RetryPolicies."+name+".MaxThrottledElapsedTime", "must be greater than 0")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func uuid() (string, error) {
@@ -0,0 +1,77 @@
+package lease
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestConfigIntervals(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.PanicLevel
+	config := &Config{LeaseTable: "test", Logger: logger, ExpireAfter: time.Minute}
+	config.defaults()
+	assert(t, config.TakerInterval == (time.Minute+config.epsilonMills)*2, "expect default taker interval")
+	assert(t, config.RenewerInterval == time.Minute/3-config.epsilonMills, "expect default renewer interval")
+
+	config = &Config{LeaseTable: "test", Logger: logger, RenewerInterval: time.Second, Jitter: 0.5}
+	config.defaults()
+	assert(t, config.RenewerInterval == time.Second, "expect to keep the renewer interval")
+	c := &Coordinator{Config: config}
+	for i := 0; i < 100; i++ {
+		d := c.jitter(config.RenewerInterval)
+		assert(t, d > time.Second/2 && d <= time.Second, "expect jitter to cut up to half of the interval")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.PanicLevel
+	config := &Config{LeaseTable: "test", Logger: logger}
+	assert(t, config.Validate() == nil, "expect the default config to be valid")
+	assert(t, config.WorkerTable == "" && config.WorkerId == "" && config.Client == nil,
+		"expect Validate not to change the config")
+	assert(t, config.Logger == logger, "expect Validate not to wrap the logger")
+
+	config = &Config{
+		Logger:          logger,
+		ExpireAfter:     5 * time.Second,
+		StealCooldown:   -time.Second,
+		Jitter:          1,
+		RenewerInterval: time.Minute,
+	}
+	err := config.Validate()
+	errs, ok := err.(ValidationErrors)
+	assert(t, ok, "expect to returns ValidationErrors")
+	fields := make(map[string]bool)
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	for _, field := range []string{"LeaseTable", "ExpireAfter", "StealCooldown", "Jitter", "RenewerInterval"} {
+		assert(t, fields[field], "expect an error for the invalid field "+field)
+	}
+	assert(t, len(errs) == 5, "expect an error for each invalid field")
+
+	_, err = NewLeaser(&Config{Logger: logger})
+	assert(t, err != nil, "expect NewLeaser to returns the validation error")
+
+	config = &Config{LeaseTable: "test", Logger: logger, Client: newClientMock(nil)}
+	_, err = NewLeaser(config)
+	assert(t, err == nil, "expect NewLeaser not to fail")
+	assert(t, config.WorkerTable == "test-workers" && config.WorkerId != "", "expect NewLeaser to set the defaults")
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	config := &Config{ExpireAfter: time.Second}
+	_, err := NewLeaser(config)
+	_, ok := err.(ValidationErrors)
+	assert(t, ok, "expect NewLeaser to return the validation errors")
+	assert(t, config.Logger == nil && config.Client == nil && config.WorkerId == "", "expect the invalid config to be untouched")
+
+	defer func() {
+		_, ok := recover().(ValidationErrors)
+		assert(t, ok, "expect New to panic with the validation errors")
+	}()
+	New(&Config{ExpireAfter: time.Second})
+}
@@ -1,6 +1,9 @@
 package lease
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 // Coordinator is the implemtation of the Leaser interface.
 // It's abstracts away LeaseTaker and LeaseRenewer from the application
@@ -12,16 +15,36 @@ type Coordinator struct {
 	Renewer Renewer
 	Taker   Taker
 	// coordinator state
-	stopTaker  chan struct{}
-	stopRenwer chan struct{}
+	stopTaker     chan struct{}
+	stopRenwer    chan struct{}
+	stopHeartbeat chan struct{}
 }
 
 // Taker or Renewer loop function
 type loopFunc func() error
 
 // New create new Coordinator with the given config.
+// It panics if the config is invalid. use NewLeaser to handle an invalid config.
 func New(config *Config) Leaser {
+	leaser, err := NewLeaser(config)
+	if err != nil {
+		panic(err)
+	}
+	return leaser
+}
+
+// NewLeaser create new Coordinator with the given config. The unset fields of
+// the config are set to their defaults. It returns ValidationErrors if the config
+// is invalid(see Config.Validate). The config is validated before its defaults
+// are set, so an invalid config is left untouched.
+func NewLeaser(config *Config) (Leaser, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	config.defaults()
+	if config.WorkerId == "" {
+		return nil, ValidationErrors{{Field: "WorkerId", Reason: "failed to generate uuid. WorkerId is required field"}}
+	}
 	manager := &LeaseManager{config, newSerializer()}
 	return &Coordinator{
 		Config:  config,
@@ -35,30 +58,35 @@ func New(config *Config) Leaser {
 			Config:    config,
 			manager:   manager,
 			allLeases: make(map[string]*Lease),
+			handoffs:  make(map[string]time.Time),
 		},
-	}
+	}, nil
 }
 
-// Start create the leases table if it's not exist and
-// then start background leaseHolder and leaseTaker handling.
+// Start create the leases and workers tables if they're not exist and
+// then start background heartbeat, leaseHolder and leaseTaker handling.
 func (c *Coordinator) Start() error {
 	if err := c.Manager.CreateLeaseTable(); err != nil {
 		return err
 	}
+	if err := c.Manager.CreateWorkerTable(); err != nil {
+		return err
+	}
 
-	takerIntervalMills := (c.ExpireAfter + c.epsilonMills) * 2
-	renewerIntervalMills := c.ExpireAfter/3 - c.epsilonMills
-
-	c.stopTaker = c.loop(c.Taker.Take, takerIntervalMills, "take leases")
-	c.stopRenwer = c.loop(c.Renewer.Renew, renewerIntervalMills, "renew leases")
+	// heartbeat as often as we renew, so other workers see us as alive
+	// before our first lease expires.
+	c.stopHeartbeat = c.loop(c.heartbeat, c.RenewerInterval, "send heartbeat")
+	c.stopTaker = c.loop(c.Taker.Take, c.TakerInterval, "take leases")
+	c.stopRenwer = c.loop(c.Renewer.Renew, c.RenewerInterval, "renew leases")
 
 	c.Logger.Infof("Start coordinator with failover time %s, and epsilon %s. "+
 		"LeaseCoordinator will renew leases every %s, take leases every %s "+
-		"and steal %d lease(s) at a time.",
+		"(with jitter of %.2f) and steal %d lease(s) at a time.",
 		c.ExpireAfter,
 		c.epsilonMills,
-		renewerIntervalMills,
-		takerIntervalMills,
+		c.RenewerInterval,
+		c.TakerInterval,
+		c.Jitter,
 		c.MaxLeasesToStealAtOneTime)
 
 	return nil
@@ -80,6 +108,17 @@ func (c *Coordinator) Stop() {
 	// wait for close
 	<-c.stopRenwer
 
+	// stop heartbeat loop
+	c.stopHeartbeat <- struct{}{}
+
+	// wait for close
+	<-c.stopHeartbeat
+
+	// leave the fleet, so other workers won't count us anymore.
+	if err := c.Manager.DeleteWorker(c.WorkerId); err != nil {
+		c.Logger.WithError(err).Errorf("Worker %s failed to delete its heartbeat", c.WorkerId)
+	}
+
 	c.Logger.Info("stopped coordinator")
 }
 
@@ -90,15 +129,24 @@ func (c *Coordinator) GetHeldLeases() []Lease {
 	return c.Renewer.GetHeldLeases()
 }
 
+// ListWorkers returns the workers that recorded a heartbeat, with the time they
+// were last seen. workers that stopped gracefully are not returned, but
+// workers that crashed are returned until one of the takers removes them.
+func (c *Coordinator) ListWorkers() ([]Worker, error) {
+	return c.Manager.ListWorkers()
+}
+
 // Delete the given lease from DB. does nothing when passed a lease that does
 // not exist in the DB.
-// The deletion is conditional on the fact that the lease is being held by this worker.
+// The deletion is conditional on the fact that the lease is being held by this worker,
+// and returns ErrOwnershipLost if it's not.
 func (c *Coordinator) Delete(l Lease) error {
 	return c.Manager.DeleteLease(&l)
 }
 
 // Create a new lease.
-// Conditional on a lease not already existing with different owner and counter.
+// Conditional on a lease not already existing with different owner and counter, and
+// returns ErrLeaseExists if it does.
 func (c *Coordinator) Create(lease Lease) (Lease, error) {
 	clease, err := c.Manager.CreateLease(&lease)
 	if err != nil {
@@ -110,38 +158,48 @@ func (c *Coordinator) Create(lease Lease) (Lease, error) {
 // Update used to update only the extra fields on the Lease object and
 // it cannot be used to update internal fields such as leaseCounter, leaseOwner.
 //
-// Fails if we do not hold the lease, or if the concurrency token does not match
-// the concurrency token on the internal authoritative copy of the lease
-// (ie, if we lost and re-acquired the lease).
+// Fails with ErrLeaseNotHeld if we do not hold the lease, or with ErrTokenNotMatch
+// if the concurrency token does not match the concurrency token on the internal
+// authoritative copy of the lease (ie, if we lost and re-acquired the lease).
+// The write itself is conditional on the lease still being held by this worker in
+// DynamoDB, and returns ErrOwnershipLost if it was taken in the meantime.
 //
 // With this method you will be able to update the task status, or any
 // other fields.
 // for example: {"status": "done", "last_update": "unix seconds"}
 // To add extra fields on a Lease, use Lease.Set(key, val)
+// To update extra fields atomically(e.g: a counter), use Lease.Incr(key, n)
+// To reschedule a lease, set its NotBefore time. the lease is released on the next
+// run of the Renewer, and it's taken again(by any worker) after its NotBefore time.
+// The returned lease keeps the concurrency token of the passed-in lease, so it
+// could be passed to the next Update, Checkpoint or Complete calls.
 func (c *Coordinator) Update(lease Lease) (Lease, error) {
-	var heldLease Lease
-	for _, hlease := range c.Renewer.GetHeldLeases() {
-		if lease.Key == hlease.Key {
-			heldLease = hlease
-			break
-		}
+	if err := c.checkHeld("update", lease); err != nil {
+		return lease, err
 	}
-
-	// fails if we don't hold the passed-in lease object
-	if heldLease.hasNoOwner() {
-		return lease, ErrLeaseNotHeld
+	ulease, err := c.Manager.UpdateHeldLease(&lease)
+	if err != nil {
+		return lease, err
 	}
+	ulease.concurrencyToken = lease.concurrencyToken
+	return *ulease, nil
+}
 
-	// or if the concurrency token does not match
-	if heldLease.concurrencyToken != lease.concurrencyToken {
-		return lease, ErrTokenNotMatch
+// Checkpoint writes the given checkpoint on the lease. The last checkpoint is
+// available on Lease.Checkpoint, so the next owner of the lease could resume from it.
+//
+// Like Update, fails if we do not hold the lease, or if the concurrency token does
+// not match. The write itself is conditional on the lease still being held by this
+// worker in DynamoDB, and returns ErrOwnershipLost if it was taken in the meantime.
+func (c *Coordinator) Checkpoint(lease Lease, checkpoint string) (Lease, error) {
+	if err := c.checkHeld("checkpoint", lease); err != nil {
+		return lease, err
 	}
-
-	ulease, err := c.Manager.UpdateLease(&lease)
-	if err != nil {
+	if err := c.Manager.CheckpointLease(&lease, checkpoint); err != nil {
 		return lease, err
 	}
-	return *ulease, nil
+	c.Renewer.SetCheckpoint(lease.Key, checkpoint)
+	return lease, nil
 }
 
 // ForceUpdate used to update the lease object without checking if the concurrency
@@ -160,6 +218,52 @@ func (c *Coordinator) ForceUpdate(lease Lease) (Lease, error) {
 	return *ulease, nil
 }
 
+// Complete marks the given lease as completed. Completed leases have no owner, and
+// they're never renewed or taken again. If Config.CompletedRetention is set,
+// completed leases are deleted after the retention period.
+//
+// Like Update, fails if we do not hold the lease, or if the concurrency token does
+// not match. The write itself is conditional on the lease still being held by this
+// worker in DynamoDB, and returns ErrOwnershipLost if it was taken in the meantime.
+func (c *Coordinator) Complete(lease Lease) (Lease, error) {
+	if err := c.checkHeld("complete", lease); err != nil {
+		return lease, err
+	}
+	if err := c.Manager.CompleteLease(&lease); err != nil {
+		return lease, err
+	}
+	return lease, nil
+}
+
+// checkHeld fails if we don't hold the passed-in lease object, or if the
+// concurrency token does not match the authoritative lease. the op string
+// used for the returned error.
+func (c *Coordinator) checkHeld(op string, lease Lease) error {
+	var heldLease Lease
+	for _, hlease := range c.Renewer.GetHeldLeases() {
+		if lease.Key == hlease.Key {
+			heldLease = hlease
+			break
+		}
+	}
+
+	// fails if we don't hold the passed-in lease object
+	if heldLease.hasNoOwner() {
+		return &Error{Op: op, Key: lease.Key, Kind: ErrLeaseNotHeld}
+	}
+
+	// or if the concurrency token does not match
+	if heldLease.concurrencyToken != lease.concurrencyToken {
+		return &Error{Op: op, Key: lease.Key, Kind: ErrTokenNotMatch}
+	}
+	return nil
+}
+
+// heartbeat records that this worker is alive.
+func (c *Coordinator) heartbeat() error {
+	return c.Manager.Heartbeat(&Worker{Id: c.WorkerId, Labels: c.Labels, Zone: c.Zone})
+}
+
 // loop spawn a goroutine and returns a "done" channel that linked to this goroutine.
 // the interval used to create a ticker to run the given loopFunc each x time and
 // the reason string used for logging.
@@ -187,11 +291,12 @@ func (c *Coordinator) loop(fn loopFunc, interval time.Duration, reason string) c
 }
 
 // ticker returns time.Time channel that called with zero value in the first call.
-// used to start 'taking'(or 'renewing') leases immediately.
+// used to start 'taking'(or 'renewing') leases immediately. the following calls
+// wait for the given duration, minus the jitter.
 func (c *Coordinator) ticker(d time.Duration) func() <-chan time.Time {
 	firstTime := true
 	return func() <-chan time.Time {
-		sleepTime := d
+		sleepTime := c.jitter(d)
 		if firstTime {
 			firstTime = false
 			sleepTime = 0
@@ -199,3 +304,9 @@ func (c *Coordinator) ticker(d time.Duration) func() <-chan time.Time {
 		return time.After(sleepTime)
 	}
 }
+
+// jitter cuts a random fraction(up to Jitter) from the given interval.
+// the interval is never extended, so the jitter cannot delay renewals.
+func (c *Coordinator) jitter(d time.Duration) time.Duration {
+	return d - time.Duration(rand.Float64()*c.Jitter*float64(d))
+}
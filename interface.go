@@ -2,6 +2,8 @@ package lease
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -22,7 +24,8 @@ const (
 )
 
 var (
-	// ErrTokenNotMatch and ErrLeaseNotHeld could be return only on the Update() call.
+	// ErrTokenNotMatch and ErrLeaseNotHeld could be return only on the Update(), Checkpoint()
+	// and Complete() calls.
 	//
 	// If the concurrency token of the passed-in lease doesn't match the
 	// concurrency token of the authoritative lease, it means the lease was
@@ -37,8 +40,69 @@ var (
 	// type.
 	// for example: StringSet type excepts only []string{...}
 	ErrValueNotMatch = errors.New("leaser: field value does not match the field type")
+	// ErrOwnershipLost error will be returns if a conditional write on a lease fails, because
+	// the lease was taken by another worker(or lost and re-acquired by this worker), or
+	// changed by its owner since the passed-in lease object was read.
+	ErrOwnershipLost = errors.New("leaser: worker lost the ownership of the lease")
+	// ErrLeaseExists error will be returns only on the Create() call, if a lease with the
+	// same key already exists with different owner and counter.
+	ErrLeaseExists = errors.New("leaser: lease already exists")
+	// ErrLeaseNotFound error will be returns only on the Update() and ForceUpdate() calls,
+	// if the lease does not exist in DynamoDB.
+	ErrLeaseNotFound = errors.New("leaser: lease does not exist")
+	// ErrThrottled error will be returns if a DynamoDB operation was throttled, even after
+	// it was retried according to its RetryPolicy.
+	ErrThrottled = errors.New("leaser: operation was throttled")
+	// ErrInvalidExpiry error will be returns only on the Create() call, if the ExpireAfter
+	// of the lease is shorter than Config.ExpireAfter.
+	ErrInvalidExpiry = errors.New("leaser: lease expiry is shorter than Config.ExpireAfter")
 )
 
+// Error is the error returned by the Manager and the Leaser methods. It records the
+// failed operation and the key of its lease, and it could be inspected using errors.Is
+// against the sentinel errors above, or using errors.As for the underlying DynamoDB error.
+//
+//    if errors.Is(err, lease.ErrLeaseExists) {
+//        // ...
+//    }
+type Error struct {
+	// Op is the failed operation. for example: "create", "update" or "renew".
+	Op string
+	// Key is the key of the lease, the id of the worker or the name of the table the
+	// operation was called on. it's empty for scans.
+	Key string
+	// Kind is the sentinel error that describes the failure(e.g: ErrLeaseExists), or nil
+	// if it's unknown.
+	Kind error
+	// Err is the underlying error(e.g: an awserr.Error), or nil if the failure was
+	// detected without calling DynamoDB.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := "leaser: " + e.Op
+	if e.Key != "" {
+		msg += fmt.Sprintf(" %q", e.Key)
+	}
+	if e.Kind != nil {
+		msg += ": " + strings.TrimPrefix(e.Kind.Error(), "leaser: ")
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the kind of the error is the given target.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
 // Lease type contains data pertianing to a Lease.
 // Distributed systems may use leases to partition work across a fleet of workers.
 // Each unit of work/task identified by a leaseKey and has a corresponding Lease.
@@ -51,9 +115,76 @@ type Lease struct {
 	Owner   string `dynamodbav:"leaseOwner"`
 	Counter int    `dynamodbav:"leaseCounter"`
 
+	// Epoch is incremented each time the lease is taken, and used to make sure
+	// that a checkpoint is written only by the worker that currently holds the lease.
+	Epoch int `dynamodbav:"leaseEpoch"`
+
+	// Checkpoint is the last checkpoint that was written on the lease using
+	// Leaser.Checkpoint. the next owner of the lease should resume from there.
+	Checkpoint string `dynamodbav:"leaseCheckpoint"`
+
+	// PreviousOwner is the last worker that held the lease before it was
+	// evicted or stolen. The Taker prefers to re-acquire leases that were
+	// previously owned by its worker(e.g: after a restart).
+	PreviousOwner string `dynamodbav:"leasePreviousOwner"`
+
+	// PendingOwner is the worker that asked the current owner to hand off the
+	// lease(see Config.HandoffTimeout).
+	PendingOwner string `dynamodbav:"leasePendingOwner"`
+
+	// Requirements are the labels a worker must have to take this lease.
+	// A worker is eligible to take the lease only if all the requirements
+	// match its labels(see Config.Labels).
+	Requirements map[string]string `dynamodbav:"leaseRequirements"`
+
+	// Priority of the lease. The Taker takes available leases with higher priority
+	// first, and never steals leases with priority above Config.MaxStealPriority.
+	// defaults to 0.
+	Priority int `dynamodbav:"leasePriority"`
+
+	// Parents are the keys of the leases that must be completed before this lease
+	// can be taken(e.g: a resharded child partition). A parent that does not exist
+	// in the table is regarded as completed.
+	Parents []string `dynamodbav:"leaseParents"`
+
+	// Completed is the completion marker of the lease. Completed leases are never
+	// renewed or taken again, and they make the children of this lease takeable.
+	// Use Leaser.Complete to mark a held lease as completed(it's not written by Update).
+	Completed bool `dynamodbav:"leaseCompleted"`
+
+	// CompletedAt is the time the lease was completed using Leaser.Complete,
+	// according to the clock of the worker that completed it.
+	CompletedAt time.Time `dynamodbav:"-"`
+
+	// NotBefore is the time before which the lease cannot be taken(e.g: a scheduled
+	// job, or a retry with backoff), according to the clock of the taking worker.
+	// Leases created with NotBefore in the future are created without owner.
+	NotBefore time.Time `dynamodbav:"-"`
+
+	// ExpireAfter is how long the lease can live without renovation before expiration,
+	// for leases that tolerate slower failover than Config.ExpireAfter(e.g: long-running
+	// batch jobs). The Renewer renews such leases less often. Create fails with
+	// ErrInvalidExpiry for values shorter than Config.ExpireAfter, so set
+	// Config.ExpireAfter to the shortest expiry.
+	ExpireAfter time.Duration `dynamodbav:"-"`
+
+	// MaxHoldDuration is the maximum time a worker holds the lease before it
+	// releases it, to let another worker take it. defaults to Config.MaxHoldDuration.
+	MaxHoldDuration time.Duration `dynamodbav:"-"`
+
+	// RenewedAt is the time the lease was last renewed(or taken), according to the clock
+	// of the worker that renewed it. It's written only in wall-clock expiry mode(see
+	// Config.WallClockExpiry).
+	RenewedAt time.Time `dynamodbav:"-"`
+
 	// lastRenewal is used by LeaseTaker to track the last time a lease counter was incremented.
 	// It is deliberately not persisted in DynamoDB.
 	lastRenewal time.Time
+	// acquiredAt and stolenAt are used by LeaseTaker to track the last time it saw
+	// the lease owner change, and the last time it saw the lease move between two owners.
+	// They are deliberately not persisted in DynamoDB.
+	acquiredAt time.Time
+	stolenAt   time.Time
 	// concurrencyToken is used to prevent updates to leases that we have lost and re-acquired.
 	// It is deliberately not persisted in DynamoDB.
 	concurrencyToken string
@@ -63,6 +194,31 @@ type Lease struct {
 	explicitfields map[string]*dynamodb.AttributeValue
 	// removed attributes; used to create the update expression.
 	removedfields []string
+	// atomic updates of fields, that set using the Incr, AppendList, AddToSet and
+	// DeleteFromSet methods; used to create the update expression.
+	updatedfields map[string]*fieldUpdate
+}
+
+// updateAction is the atomic update of a field.
+type updateAction int
+
+const (
+	// incr adds a number to a number field.
+	incr updateAction = iota
+	// appendList appends values to a list field.
+	appendList
+	// addToSet adds elements to a set field.
+	addToSet
+	// deleteFromSet deletes elements from a set field.
+	deleteFromSet
+)
+
+// fieldUpdate is a pending atomic update of a field.
+type fieldUpdate struct {
+	action updateAction
+	n      int
+	list   []interface{}
+	set    *dynamodb.AttributeValue
 }
 
 // NewLease gets a key(represents the lease key/name) and returns a new Lease object.
@@ -76,7 +232,7 @@ func NewLease(key string) Lease {
 // Use this method to add meta-data on the lease. for example:
 //
 //    lease.Set("success", true)
-//    lease.Set("checkpoint", 35465786912)
+//    lease.Set("offset", 35465786912)
 func (l *Lease) Set(key string, val interface{}) {
 	if l.extrafields == nil {
 		l.extrafields = make(map[string]interface{})
@@ -84,6 +240,7 @@ func (l *Lease) Set(key string, val interface{}) {
 	l.extrafields[key] = val
 	// make sure that this key does not exists in the explicit fields map
 	delete(l.explicitfields, key)
+	delete(l.updatedfields, key)
 }
 
 // SetAs is like the Set method, but with another argument "typ" that explicitly
@@ -96,40 +253,160 @@ func (l *Lease) Set(key string, val interface{}) {
 //
 // Error will be returns only if the field value does not match the field type.
 func (l *Lease) SetAs(key string, val interface{}, typ AttributeType) error {
+	v, ok := setValue(val, typ)
+	if !ok {
+		return ErrValueNotMatch
+	}
 	if l.explicitfields == nil {
 		l.explicitfields = make(map[string]*dynamodb.AttributeValue)
 	}
-	ok := false
+	l.explicitfields[key] = v
+	// make sure that this key does not exists in the extra fields map
+	delete(l.extrafields, key)
+	delete(l.updatedfields, key)
+	return nil
+}
+
+// setValue returns the DynamoDB set of the given type, and false if the
+// value does not match the type.
+func setValue(val interface{}, typ AttributeType) (*dynamodb.AttributeValue, bool) {
 	switch typ {
-	case StringSet, NumberSet:
-		var ss []string
-		if ss, ok = val.([]string); ok {
-			v := &dynamodb.AttributeValue{
-				SS: aws.StringSlice(ss),
-			}
-			if typ == NumberSet {
-				v = &dynamodb.AttributeValue{
-					NS: aws.StringSlice(ss),
-				}
-			}
-			l.explicitfields[key] = v
+	case StringSet:
+		if ss, ok := val.([]string); ok {
+			return &dynamodb.AttributeValue{SS: aws.StringSlice(ss)}, true
+		}
+	case NumberSet:
+		if ss, ok := val.([]string); ok {
+			return &dynamodb.AttributeValue{NS: aws.StringSlice(ss)}, true
 		}
 	case BinarySet:
-		var bs [][]byte
-		if bs, ok = val.([][]byte); ok {
-			l.explicitfields[key] = &dynamodb.AttributeValue{
-				BS: bs,
-			}
+		if bs, ok := val.([][]byte); ok {
+			return &dynamodb.AttributeValue{BS: bs}, true
 		}
 	}
+	return nil, false
+}
+
+// Incr atomically adds n to a number field(metadata) when the lease is updated using
+// the Leaser, so concurrent increments are never lost. a field that does not exist is
+// regarded as 0. the updated value is available on the returned lease.
+//
+// For example:
+//
+//    lease.Incr("processed", 100)
+//    lease, err = leaser.Update(lease)
+//    processed, _ := lease.Get("processed")
+//
+// Like all the atomic updates, it overrides a previous Set, SetAs, Del or atomic update
+// of the same field, unless it's the same update(e.g: two Incr calls are added up).
+func (l *Lease) Incr(key string, n int) {
+	if u, ok := l.updatedfields[key]; ok && u.action == incr {
+		u.n += n
+		return
+	}
+	l.update(key, &fieldUpdate{action: incr, n: n})
+}
+
+// AppendList atomically appends the given values to a list field(metadata) when the
+// lease is updated using the Leaser. a field that does not exist is regarded as an
+// empty list. the updated list is available on the returned lease.
+func (l *Lease) AppendList(key string, vals ...interface{}) {
+	if u, ok := l.updatedfields[key]; ok && u.action == appendList {
+		u.list = append(u.list, vals...)
+		return
+	}
+	l.update(key, &fieldUpdate{action: appendList, list: vals})
+}
+
+// AddToSet atomically adds the given elements to a set field(metadata) of the given
+// type when the lease is updated using the Leaser. a field that does not exist is
+// created. the updated set is available on the returned lease.
+//
+// For example:
+//
+//    lease.AddToSet("shards", []string{"shard-1", "shard-2"}, StringSet)
+//
+// Error will be returns only if the elements do not match the set type.
+func (l *Lease) AddToSet(key string, val interface{}, typ AttributeType) error {
+	return l.updateSet(key, val, typ, addToSet)
+}
+
+// DeleteFromSet atomically deletes the given elements from a set field(metadata) of
+// the given type when the lease is updated using the Leaser. the updated set is
+// available on the returned lease, and a set without elements is removed.
+//
+// Error will be returns only if the elements do not match the set type.
+func (l *Lease) DeleteFromSet(key string, val interface{}, typ AttributeType) error {
+	return l.updateSet(key, val, typ, deleteFromSet)
+}
+
+// updateSet adds a set update of the given action to the lease.
+func (l *Lease) updateSet(key string, val interface{}, typ AttributeType, action updateAction) error {
+	v, ok := setValue(val, typ)
 	if !ok {
 		return ErrValueNotMatch
 	}
-	// make sure that this key does not exists in the extra fields map
-	delete(l.extrafields, key)
+	if u, ok := l.updatedfields[key]; ok && u.action == action {
+		if set, ok := mergeSets(u.set, v); ok {
+			u.set = set
+			return nil
+		}
+	}
+	l.update(key, &fieldUpdate{action: action, set: v})
 	return nil
 }
 
+// update sets the atomic update of the given field, and makes sure that this key does
+// not exists in the other fields maps.
+func (l *Lease) update(key string, u *fieldUpdate) {
+	if l.updatedfields == nil {
+		l.updatedfields = make(map[string]*fieldUpdate)
+	}
+	l.updatedfields[key] = u
+	delete(l.extrafields, key)
+	delete(l.explicitfields, key)
+}
+
+// mergeSets returns the union of the given sets, and false if their types do not match.
+func mergeSets(a, b *dynamodb.AttributeValue) (*dynamodb.AttributeValue, bool) {
+	switch {
+	case a.SS != nil && b.SS != nil:
+		return &dynamodb.AttributeValue{SS: union(a.SS, b.SS)}, true
+	case a.NS != nil && b.NS != nil:
+		return &dynamodb.AttributeValue{NS: union(a.NS, b.NS)}, true
+	case a.BS != nil && b.BS != nil:
+		seen := make(map[string]bool)
+		for _, v := range a.BS {
+			seen[string(v)] = true
+		}
+		bs := a.BS
+		for _, v := range b.BS {
+			if !seen[string(v)] {
+				seen[string(v)] = true
+				bs = append(bs, v)
+			}
+		}
+		return &dynamodb.AttributeValue{BS: bs}, true
+	}
+	return nil, false
+}
+
+// union returns the union of the given string slices. DynamoDB rejects sets with
+// duplicate elements.
+func union(a, b []*string) []*string {
+	seen := make(map[string]bool)
+	for _, s := range a {
+		seen[*s] = true
+	}
+	for _, s := range b {
+		if !seen[*s] {
+			seen[*s] = true
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
 // Get extra field(metadata) from the Lease object that not belongs to this package.
 func (l *Lease) Get(key string) (interface{}, bool) {
 	if val, ok := l.extrafields[key]; ok {
@@ -156,15 +433,57 @@ func (l *Lease) Del(key string) {
 		delete(l.extrafields, key)
 	} else if _, ok = l.explicitfields[key]; ok {
 		delete(l.explicitfields, key)
+	} else if _, ok = l.updatedfields[key]; ok {
+		delete(l.updatedfields, key)
 	}
 	if ok {
 		l.removedfields = append(l.removedfields, key)
 	}
 }
 
-// isExpired test if the lease renewal is expired from the given time.
+// isExpired test if the lease renewal is expired from the given time, or from
+// the lease expiry if it's longer.
 func (l *Lease) isExpired(t time.Duration) bool {
-	return time.Since(l.lastRenewal) > t
+	return time.Since(l.lastRenewal) > l.expireAfter(t)
+}
+
+// expireAfter returns the expiry of the lease, or the given default if it's
+// not set or shorter.
+func (l *Lease) expireAfter(d time.Duration) time.Duration {
+	if l.ExpireAfter > d {
+		return l.ExpireAfter
+	}
+	return d
+}
+
+// wasOwnedBy return true if the given worker is the current or the previous
+// owner of the lease.
+func (l *Lease) wasOwnedBy(workerId string) bool {
+	return l.Owner == workerId || l.PreviousOwner == workerId
+}
+
+// matches return true if the given labels satisfy the lease requirements.
+func (l *Lease) matches(labels map[string]string) bool {
+	for k, v := range l.Requirements {
+		if label, ok := labels[k]; !ok || label != v {
+			return false
+		}
+	}
+	return true
+}
+
+// isScheduled returns true if the lease cannot be taken before a future time.
+func (l *Lease) isScheduled() bool {
+	return time.Now().Before(l.NotBefore)
+}
+
+// maxHoldDuration returns the max hold duration of the lease, or the given
+// default if it's not set.
+func (l *Lease) maxHoldDuration(d time.Duration) time.Duration {
+	if l.MaxHoldDuration > 0 {
+		return l.MaxHoldDuration
+	}
+	return d
 }
 
 // hasNoOwner return true if the current owner is null.
@@ -172,7 +491,27 @@ func (l *Lease) hasNoOwner() bool {
 	return l.Owner == "NULL" || l.Owner == ""
 }
 
+// Worker is a member of the fleet, as seen in the workers table.
+// Each Coordinator records a heartbeat on behalf of its worker while it's
+// running, so idle workers(that don't hold any lease) are visible as well.
+type Worker struct {
+	Id string
+	// LastSeen is the time of the last heartbeat, according to the clock of
+	// the worker that sent it.
+	LastSeen time.Time
+	// Labels are the worker labels, as set in its Config.
+	Labels map[string]string
+	// Zone is the worker availability zone, as set in its Config.
+	Zone string
+}
+
+// isExpired test if the worker did not send a heartbeat since the given duration.
+func (w *Worker) isExpired(t time.Duration) bool {
+	return time.Since(w.LastSeen) > t
+}
+
 // Leaser is the interface that wraps the Coordinator methods.
+// The errors returned by its methods are of type *Error.
 type Leaser interface {
 	Stop()
 	Start() error
@@ -180,5 +519,8 @@ type Leaser interface {
 	Create(Lease) (Lease, error)
 	Update(Lease) (Lease, error)
 	ForceUpdate(Lease) (Lease, error)
+	Checkpoint(Lease, string) (Lease, error)
+	Complete(Lease) (Lease, error)
 	GetHeldLeases() []Lease
+	ListWorkers() ([]Worker, error)
 }
@@ -4,6 +4,9 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
 func TestLeaseMetaData(t *testing.T) {
@@ -52,3 +55,81 @@ func TestLeaseMetaData(t *testing.T) {
 		t.Error("expect lease not to be expired")
 	}
 }
+
+func TestLeaseAtomicUpdates(t *testing.T) {
+	l := NewLease("foo")
+
+	// Incr overrides Set, and increments are added up
+	l.Set("count", 1)
+	l.Incr("count", 2)
+	l.Incr("count", 3)
+	if _, ok := l.Get("count"); ok {
+		t.Error("expect Incr to override Set")
+	}
+	if u := l.updatedfields["count"]; u.action != incr || u.n != 5 {
+		t.Errorf("\ngot: %v\nexpected: %v", u.n, 5)
+	}
+
+	// AppendList values are appended in order
+	l.AppendList("list", "a", "b")
+	l.AppendList("list", "c")
+	if u := l.updatedfields["list"]; !reflect.DeepEqual(u.list, []interface{}{"a", "b", "c"}) {
+		t.Errorf("\ngot: %v\nexpected: %v", u.list, []string{"a", "b", "c"})
+	}
+
+	// AddToSet elements are merged without duplicates
+	if err := l.AddToSet("set", 1, StringSet); err != ErrValueNotMatch {
+		t.Error("expect AddToSet to returns ErrValueNotMatch")
+	}
+	l.AddToSet("set", []string{"a", "b"}, StringSet)
+	l.AddToSet("set", []string{"b", "c"}, StringSet)
+	if u := l.updatedfields["set"]; !reflect.DeepEqual(u.set.SS, aws.StringSlice([]string{"a", "b", "c"})) {
+		t.Errorf("\ngot: %v\nexpected: %v", u.set.SS, []string{"a", "b", "c"})
+	}
+
+	// DeleteFromSet overrides AddToSet
+	l.DeleteFromSet("set", []string{"a"}, StringSet)
+	if u := l.updatedfields["set"]; u.action != deleteFromSet || len(u.set.SS) != 1 {
+		t.Error("expect DeleteFromSet to override AddToSet")
+	}
+
+	// Set and Del override atomic updates
+	l.Set("count", 1)
+	if _, ok := l.updatedfields["count"]; ok {
+		t.Error("expect Set to override Incr")
+	}
+	l.Del("list")
+	if _, ok := l.updatedfields["list"]; ok || len(l.removedfields) != 1 {
+		t.Error("expect Del to override AppendList")
+	}
+}
+
+func TestLeaseExtraFieldNames(t *testing.T) {
+	// extra fields named like the lease attributes, without the "lease" prefix.
+	item := map[string]*dynamodb.AttributeValue{
+		LeaseKeyKey:       {S: aws.String("foo")},
+		"priority":        {S: aws.String("high")},
+		"renewedAt":       {S: aws.String("yesterday")},
+		"expireAfter":     {N: aws.String("60000")},
+		"maxHoldDuration": {N: aws.String("60000")},
+		"pendingOwner":    {N: aws.String("2")},
+		"notBefore":       {N: aws.String("4102444800000")},
+		"completed":       {BOOL: aws.Bool(true)},
+		"completedAt":     {S: aws.String("yesterday")},
+		"checkpoint":      {N: aws.String("35465786912")},
+		"parents":         {S: aws.String("bar")},
+		"requirements":    {S: aws.String("gpu")},
+		"previousOwner":   {N: aws.String("1")},
+	}
+	lease, err := newSerializer().Decode(item)
+	assert(t, err == nil, "expect to decode the lease")
+	assert(t, lease.Priority == 0, "expect not to read the extra field as the lease priority")
+	assert(t, lease.RenewedAt.IsZero(), "expect not to read the extra field as the renewal time")
+	assert(t, lease.ExpireAfter == 0, "expect not to read the extra field as the lease expiry")
+	assert(t, lease.MaxHoldDuration == 0, "expect not to read the extra field as the max hold duration")
+	assert(t, lease.NotBefore.IsZero(), "expect not to read the extra field as the not-before time")
+	assert(t, !lease.Completed, "expect not to read the extra field as the completion marker")
+	assert(t, len(lease.Parents) == 0, "expect not to read the extra field as the lease parents")
+	v, _ := lease.Get("priority")
+	assert(t, v == "high", "expect to keep the extra field")
+}
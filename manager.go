@@ -2,6 +2,7 @@ package lease
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 )
 
 const (
@@ -17,23 +19,82 @@ const (
 	LeaseKeyKey     = "leaseKey"
 	LeaseOwnerKey   = "leaseOwner"
 	LeaseCounterKey = "leaseCounter"
+	LeaseEpochKey   = "leaseEpoch"
+
+	// Optional lease attributes. like the table schema, they're prefixed with "lease", so
+	// they do not collide with the extra fields of the application(e.g: a "priority" field),
+	// and extra fields cannot be set with these names.
+	//
+	// Migration: leases that were written with the attributes of this package without
+	// the "lease" prefix(e.g: "priority") are read with these attributes as extra fields,
+	// and their lease attributes as unset. rewrite them with the prefixed names.
+	LeasePreviousOwnerKey = "leasePreviousOwner"
+	LeasePendingOwnerKey  = "leasePendingOwner"
+	LeaseRequirementsKey  = "leaseRequirements"
+	LeasePriorityKey      = "leasePriority"
+	LeaseParentsKey       = "leaseParents"
+	LeaseCompletedKey     = "leaseCompleted"
+	LeaseCompletedAtKey   = "leaseCompletedAt"
+	LeaseCheckpointKey    = "leaseCheckpoint"
+	LeaseNotBeforeKey     = "leaseNotBefore"
+	LeaseMaxHoldKey       = "leaseMaxHoldDuration"
+	LeaseExpireAfterKey   = "leaseExpireAfter"
+	LeaseRenewedAtKey     = "leaseRenewedAt"
+
+	// StealBudgetKey is the key of the item that holds the cluster-wide steal
+	// budget in the lease table. it's never returned as a lease.
+	StealBudgetKey       = "__stealBudget"
+	StealBudgetWindowKey = "budgetWindow"
+	StealBudgetCountKey  = "budgetCount"
+
+	// Workers table schema
+	WorkerIdKey       = "workerId"
+	WorkerLastSeenKey = "lastSeen"
+	WorkerLabelsKey   = "labels"
+	WorkerZoneKey     = "zone"
 
 	// AWS exception
 	AlreadyExist      = "ResourceInUseException"
 	ConditionalFailed = "ConditionalCheckFailedException"
 
-	// Max number of retries
-	maxScanRetries   = 3
-	maxCreateRetries = 3
-	maxUpdateRetries = 2
-	maxDeleteRetries = 2
-
 	// Maximum duration to wait until the table in active state
 	maxDurationTableStatus = time.Minute * 5
 	durationBetweenPolls   = time.Second * 10
 )
 
+// schemaKeys are the lease attributes that belong to this package. they
+// cannot be set or removed as extra fields.
+var schemaKeys = []string{
+	LeaseKeyKey,
+	LeaseOwnerKey,
+	LeaseCounterKey,
+	LeaseEpochKey,
+	LeasePreviousOwnerKey,
+	LeasePendingOwnerKey,
+	LeaseRequirementsKey,
+	LeasePriorityKey,
+	LeaseParentsKey,
+	LeaseCompletedKey,
+	LeaseCompletedAtKey,
+	LeaseCheckpointKey,
+	LeaseNotBeforeKey,
+	LeaseMaxHoldKey,
+	LeaseExpireAfterKey,
+	LeaseRenewedAtKey,
+}
+
+// isSchemaKey returns true if the given attribute belongs to this package.
+func isSchemaKey(k string) bool {
+	for _, sk := range schemaKeys {
+		if sk == k {
+			return true
+		}
+	}
+	return false
+}
+
 // Manager wrap the basic operations for leases.
+// The errors returned by its methods are of type *Error.
 type Manager interface {
 	// Creates the table that will store leases if it's not already exists.
 	CreateLeaseTable() error
@@ -58,6 +119,45 @@ type Manager interface {
 
 	// Update a lease
 	UpdateLease(*Lease) (*Lease, error)
+
+	// Update a held lease
+	UpdateHeldLease(*Lease) (*Lease, error)
+
+	// Write a checkpoint on a held lease
+	CheckpointLease(*Lease, string) error
+
+	// Complete a held lease
+	CompleteLease(*Lease) error
+
+	// Ask the owner of a lease to hand it off
+	RequestHandoff(*Lease) error
+
+	// Hand off a held lease to the worker that asked for it
+	HandoffLease(*Lease) error
+
+	// Cancel the pending handoff of a held lease, and renew it
+	CancelHandoff(*Lease) error
+
+	// Creates the table that will store workers heartbeats if it's not already exists.
+	CreateWorkerTable() error
+
+	// Record a heartbeat for the given worker
+	Heartbeat(*Worker) error
+
+	// List all workers(heartbeat records) in table.
+	ListWorkers() ([]Worker, error)
+
+	// Delete the heartbeat record of the given worker
+	DeleteWorker(workerId string) error
+
+	// Delete the heartbeat record of the given worker, if it did not send a heartbeat since it was listed
+	RemoveExpiredWorker(*Worker) (bool, error)
+
+	// Reserve up to n steals from the cluster-wide steal budget
+	AcquireStealBudget(n int) (int, error)
+
+	// Return n unused steals to the cluster-wide steal budget
+	ReleaseStealBudget(n int) error
 }
 
 // LeaseManager is the default implemntation of Manager
@@ -69,19 +169,31 @@ type LeaseManager struct {
 
 // CreateLeaseTable creates the table that will store the leases. succeeds
 // if it's  already exists.
-func (l *LeaseManager) CreateLeaseTable() (err error) {
-	for l.Backoff.Attempt() < maxCreateRetries {
-		_, err = l.Client.CreateTable(&dynamodb.CreateTableInput{
-			TableName: aws.String(l.LeaseTable),
+func (l *LeaseManager) CreateLeaseTable() error {
+	return wrapError("create table", l.LeaseTable, l.createTable(l.LeaseTable, LeaseKeyKey), nil)
+}
+
+// CreateWorkerTable creates the table that will store the workers heartbeats.
+// succeeds if it's already exists.
+func (l *LeaseManager) CreateWorkerTable() error {
+	return wrapError("create table", l.WorkerTable, l.createTable(l.WorkerTable, WorkerIdKey), nil)
+}
+
+// createTable creates a table with the given name and string hash key, and
+// wait until it's active.
+func (l *LeaseManager) createTable(table, hashKey string) error {
+	err := l.retry(l.RetryPolicies.CreateTable, "create table", func() error {
+		_, err := l.Client.CreateTable(&dynamodb.CreateTableInput{
+			TableName: aws.String(table),
 			AttributeDefinitions: []*dynamodb.AttributeDefinition{
 				{
-					AttributeName: aws.String(LeaseKeyKey),
+					AttributeName: aws.String(hashKey),
 					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
 				},
 			},
 			KeySchema: []*dynamodb.KeySchemaElement{
 				{
-					AttributeName: aws.String(LeaseKeyKey),
+					AttributeName: aws.String(hashKey),
 					KeyType:       aws.String("HASH"),
 				},
 			},
@@ -90,66 +202,55 @@ func (l *LeaseManager) CreateLeaseTable() (err error) {
 				WriteCapacityUnits: aws.Int64(int64(l.LeaseTableWriteCap)),
 			},
 		})
+		return err
+	})
 
-		// if the operation finished successfully, we need to "wait" until
-		// the lease table exists and active.
-		if err == nil {
-			l.Logger.WithField("table name", l.LeaseTable).Debugf("Worker %s creates the lease table and "+
-				"wait maximum %s until it will be %q",
-				l.WorkerId,
-				maxDurationTableStatus,
-				dynamodb.TableStatusActive)
-
-			duration := maxDurationTableStatus
-
-			for {
-				success := false
-
-				if status, ok := l.tableStatus(); ok && status == dynamodb.TableStatusActive {
-					success = true
-				}
-
-				if success || duration == 0 {
-					l.Logger.WithFields(logrus.Fields{
-						"success":    success,
-						"table name": l.LeaseTable,
-						"time taken": maxDurationTableStatus - duration,
-					}).Debugf("Worker %s stop waiting for table creation", l.WorkerId)
-					break
-				}
-
-				time.Sleep(durationBetweenPolls)
-				duration -= durationBetweenPolls
-			}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == AlreadyExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-			break
+	// if the operation finished successfully, we need to "wait" until
+	// the lease table exists and active.
+	l.Logger.WithField("table name", table).Debugf("Worker %s creates the table and "+
+		"wait maximum %s until it will be %q",
+		l.WorkerId,
+		maxDurationTableStatus,
+		dynamodb.TableStatusActive)
+
+	duration := maxDurationTableStatus
+
+	for {
+		success := false
+
+		if status, ok := l.tableStatus(table); ok && status == dynamodb.TableStatusActive {
+			success = true
 		}
 
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == AlreadyExist {
-			err = nil
+		if success || duration == 0 {
+			l.Logger.WithFields(logrus.Fields{
+				"success":    success,
+				"table name": table,
+				"time taken": maxDurationTableStatus - duration,
+			}).Debugf("Worker %s stop waiting for table creation", l.WorkerId)
 			break
 		}
 
-		backoff := l.Backoff.Duration()
-
-		l.Logger.WithFields(logrus.Fields{
-			"backoff": backoff,
-			"attempt": int(l.Backoff.Attempt()),
-		}).Warnf("Worker %s failed to create table", l.WorkerId)
-
-		time.Sleep(backoff)
+		time.Sleep(durationBetweenPolls)
+		duration -= durationBetweenPolls
 	}
-	l.Backoff.Reset()
-	return
+	return nil
 }
 
 // tableStatus returns the "status" of the table, and boolean
 // that indicates if the operation success.
 //
 // The status could be: "CREATING", "UPDATING", "DELETING" or "ACTIVE"
-func (l *LeaseManager) tableStatus() (string, bool) {
+func (l *LeaseManager) tableStatus(table string) (string, bool) {
 	resp, err := l.Client.DescribeTable(&dynamodb.DescribeTableInput{
-		TableName: aws.String(l.LeaseTable),
+		TableName: aws.String(table),
 	})
 	if err != nil {
 		return "", false
@@ -157,80 +258,175 @@ func (l *LeaseManager) tableStatus() (string, bool) {
 	return *resp.Table.TableStatus, true
 }
 
-// Renew a lease by incrementing the lease counter.
+// Renew a lease by incrementing the lease counter. In wall-clock expiry mode, the
+// renewal time is written as well.
 // Conditional on the leaseCounter in DynamoDB matching the leaseCounter of the input
+// Returns ErrOwnershipLost if the condition fails.
 // Mutates the leaseCounter of the passed-in lease object after updating the record in DynamoDB.
 func (l *LeaseManager) RenewLease(lease *Lease) (err error) {
 	clease := *lease
 	clease.Counter++
+	if l.WallClockExpiry {
+		clease.RenewedAt = time.Now()
+	}
 	if err = l.condUpdate(clease, *lease); err == nil {
 		lease.Counter = clease.Counter
+		lease.RenewedAt = clease.RenewedAt
 	}
-	return
+	return wrapError("renew", lease.Key, err, ErrOwnershipLost)
 }
 
-// Evict the current owner of lease by setting owner to null
+// Evict the current owner of lease by setting owner to null, and remember it
+// as the previous owner. A pending handoff is canceled.
 // Conditional on the owner in DynamoDB matching the owner of the input.
+// Returns ErrOwnershipLost if the condition fails.
 // Mutates the lease owner of the passed-in lease object after updating the record in DynamoDB.
 func (l *LeaseManager) EvictLease(lease *Lease) (err error) {
 	clease := *lease
 	clease.Owner = "NULL"
+	clease.PendingOwner = ""
+	if !lease.hasNoOwner() {
+		clease.PreviousOwner = lease.Owner
+	}
 	if err = l.condUpdate(clease, *lease); err == nil {
 		lease.Owner = clease.Owner
+		lease.PreviousOwner = clease.PreviousOwner
+		lease.PendingOwner = clease.PendingOwner
 	}
-	return
+	return wrapError("evict", lease.Key, err, ErrOwnershipLost)
 }
 
-// Take a lease by incrementing its leaseCounter and setting its owner field.
-// Conditional on the leaseCounter in DynamoDB matching the leaseCounter of the input
-// Mutates the lease counter and owner of the passed-in lease object after updating the record in DynamoDB.
+// Take a lease by incrementing its leaseCounter and leaseEpoch, and setting its owner field.
+// If the lease has an owner, it's remembered as the previous owner. A pending handoff is canceled.
+// In wall-clock expiry mode, the renewal time is written as well.
+// Conditional on the leaseCounter in DynamoDB matching the leaseCounter of the input.
+// Returns ErrOwnershipLost if the condition fails.
+// Mutates the lease counter, epoch and owner of the passed-in lease object after updating the record in DynamoDB.
 func (l *LeaseManager) TakeLease(lease *Lease) (err error) {
+	return wrapError("take", lease.Key, l.transferLease(lease, l.WorkerId), ErrOwnershipLost)
+}
+
+// HandoffLease hands off a held lease to the worker that asked for it(i.e: its pending
+// owner), by incrementing its leaseCounter and leaseEpoch and setting its owner field.
+// The current owner is remembered as the previous owner.
+// Conditional on the leaseCounter in DynamoDB matching the leaseCounter of the input.
+// Returns ErrOwnershipLost if the condition fails.
+// Mutates the lease counter, epoch and owner of the passed-in lease object after updating the record in DynamoDB.
+func (l *LeaseManager) HandoffLease(lease *Lease) error {
+	return wrapError("handoff", lease.Key, l.transferLease(lease, lease.PendingOwner), ErrOwnershipLost)
+}
+
+// CancelHandoff cancels the pending handoff of a held lease(e.g: its pending owner is not
+// alive anymore), and renews it by incrementing its leaseCounter.
+// Conditional on the leaseCounter in DynamoDB matching the leaseCounter of the input.
+// Returns ErrOwnershipLost if the condition fails.
+// Mutates the lease counter and pending owner of the passed-in lease object after updating the record in DynamoDB.
+func (l *LeaseManager) CancelHandoff(lease *Lease) (err error) {
+	clease := *lease
+	clease.Counter++
+	clease.PendingOwner = ""
+	if l.WallClockExpiry {
+		clease.RenewedAt = time.Now()
+	}
+	if err = l.condUpdate(clease, *lease); err == nil {
+		lease.Counter = clease.Counter
+		lease.RenewedAt = clease.RenewedAt
+		lease.PendingOwner = clease.PendingOwner
+	}
+	return wrapError("cancel handoff", lease.Key, err, ErrOwnershipLost)
+}
+
+// transferLease sets the owner of the lease to the given worker, and cancels
+// its pending handoff.
+func (l *LeaseManager) transferLease(lease *Lease, owner string) (err error) {
 	clease := *lease
 	clease.Counter++
-	clease.Owner = l.WorkerId
+	clease.Epoch++
+	clease.Owner = owner
+	clease.PendingOwner = ""
+	if !lease.hasNoOwner() {
+		clease.PreviousOwner = lease.Owner
+	}
+	if l.WallClockExpiry {
+		clease.RenewedAt = time.Now()
+	}
 	if err = l.condUpdate(clease, *lease); err == nil {
+		lease.RenewedAt = clease.RenewedAt
 		lease.Owner = clease.Owner
 		lease.Counter = clease.Counter
+		lease.Epoch = clease.Epoch
+		lease.PreviousOwner = clease.PreviousOwner
+		lease.PendingOwner = clease.PendingOwner
 	}
 	return
 }
 
+// RequestHandoff asks the owner of the lease to hand it off to this worker, by
+// setting its pendingOwner field.
+// Conditional on the owner in DynamoDB matching the owner of the input, and on the
+// lease not having another pending handoff. Returns ErrOwnershipLost if the condition fails.
+// Mutates the pending owner of the passed-in lease object after updating the record in DynamoDB.
+func (l *LeaseManager) RequestHandoff(lease *Lease) error {
+	_, err := l.updateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(l.LeaseTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey: {
+				S: aws.String(lease.Key),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#owner":        aws.String(LeaseOwnerKey),
+			"#pendingOwner": aws.String(LeasePendingOwnerKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pendingOwner": {
+				S: aws.String(l.WorkerId),
+			},
+			":condOwner": {
+				S: aws.String(lease.Owner),
+			},
+		},
+		UpdateExpression:    aws.String("SET #pendingOwner = :pendingOwner"),
+		ConditionExpression: aws.String("#owner = :condOwner AND attribute_not_exists(#pendingOwner)"),
+	})
+	if err == nil {
+		lease.PendingOwner = l.WorkerId
+	}
+	return wrapError("request handoff", lease.Key, err, ErrOwnershipLost)
+}
+
 // ListLeasses returns all the lease units stored in the table.
 func (l *LeaseManager) ListLeases() (list []*Lease, err error) {
 	var res *dynamodb.ScanOutput
-	for l.Backoff.Attempt() < maxScanRetries {
+	err = l.retry(l.RetryPolicies.Scan, "scan leases table", func() (err error) {
 		res, err = l.Client.Scan(&dynamodb.ScanInput{
 			TableName: aws.String(l.LeaseTable),
 		})
-		if err != nil {
-			backoff := l.Backoff.Duration()
-
-			l.Logger.WithFields(logrus.Fields{
-				"backoff": backoff,
-				"attempt": int(l.Backoff.Attempt()),
-			}).Warnf("Worker %s failed to scan leases table", l.WorkerId)
-
-			time.Sleep(backoff)
+		return
+	})
+	if err != nil {
+		return nil, wrapError("list leases", "", err, nil)
+	}
+	for _, item := range res.Items {
+		if key := item[LeaseKeyKey]; key != nil && aws.StringValue(key.S) == StealBudgetKey {
 			continue
 		}
-		for _, item := range res.Items {
-			if lease, err := l.Serializer.Decode(item); err != nil {
-				l.Logger.WithError(err).Error("decode lease")
-			} else {
-				list = append(list, lease)
-			}
+		if lease, err := l.Serializer.Decode(item); err != nil {
+			l.Logger.WithError(err).Error("decode lease")
+		} else {
+			list = append(list, lease)
 		}
-		break
 	}
-	l.Backoff.Reset()
 	return
 }
 
 // Delete the given lease from DynamoDB. does nothing when passed a
 // lease that does not exist in DynamoDB.
-func (l *LeaseManager) DeleteLease(lease *Lease) (err error) {
-	for l.Backoff.Attempt() < maxDeleteRetries {
-		_, err = l.Client.DeleteItem(&dynamodb.DeleteItemInput{
+// Conditional on the owner in DynamoDB matching the owner of the input.
+// Returns ErrOwnershipLost if the condition fails.
+func (l *LeaseManager) DeleteLease(lease *Lease) error {
+	err := l.retry(l.RetryPolicies.Delete, "delete lease", func() error {
+		_, err := l.Client.DeleteItem(&dynamodb.DeleteItemInput{
 			TableName: aws.String(l.LeaseTable),
 			Key: map[string]*dynamodb.AttributeValue{
 				LeaseKeyKey: {
@@ -248,31 +444,26 @@ func (l *LeaseManager) DeleteLease(lease *Lease) (err error) {
 			},
 			ConditionExpression: aws.String("attribute_not_exists(#key) OR #owner = :condOwner"),
 		})
-
-		if err == nil {
-			break
-		}
-
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
-			break
-		}
-
-		backoff := l.Backoff.Duration()
-
-		l.Logger.WithFields(logrus.Fields{
-			"backoff": backoff,
-			"attempt": int(l.Backoff.Attempt()),
-		}).Warnf("Worker %s failed to delete lease", l.WorkerId)
-
-		time.Sleep(backoff)
-	}
-	l.Backoff.Reset()
-	return
+		return err
+	})
+	return wrapError("delete", lease.Key, err, ErrOwnershipLost)
 }
 
 // Create a new lease. conditional on a lease not already existing with different
-// owner and counter.
+// owner and counter. the lease is owned by this worker, unless it has parents, it's
+// scheduled to a future time or it was explicitly set.
+// Returns ErrLeaseExists if the condition fails, or ErrInvalidExpiry if the lease
+// expiry is shorter than Config.ExpireAfter.
 func (l *LeaseManager) CreateLease(lease *Lease) (*Lease, error) {
+	// leases are renewed at least 3 times in the shortest expiry(i.e: Config.ExpireAfter).
+	if lease.ExpireAfter > 0 && lease.ExpireAfter < l.ExpireAfter {
+		return lease, &Error{Op: "create", Key: lease.Key, Kind: ErrInvalidExpiry}
+	}
+	// leases with parents or scheduled leases are left without owner, so they
+	// will be taken only when their parents are completed or their time has come.
+	if lease.Owner == "" && (len(lease.Parents) > 0 || lease.isScheduled()) {
+		lease.Owner = "NULL"
+	}
 	if lease.Owner == "" {
 		lease.Owner = l.WorkerId
 	}
@@ -281,10 +472,10 @@ func (l *LeaseManager) CreateLease(lease *Lease) (*Lease, error) {
 	}
 	item, err := l.Serializer.Encode(lease)
 	if err != nil {
-		return lease, err
+		return lease, wrapError("create", lease.Key, err, nil)
 	}
-	for l.Backoff.Attempt() < maxCreateRetries {
-		_, err = l.Client.PutItem(&dynamodb.PutItemInput{
+	err = l.retry(l.RetryPolicies.Create, "create lease", func() error {
+		_, err := l.Client.PutItem(&dynamodb.PutItemInput{
 			TableName: aws.String(l.LeaseTable),
 			Item:      item,
 			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
@@ -302,29 +493,11 @@ func (l *LeaseManager) CreateLease(lease *Lease) (*Lease, error) {
 			},
 			ConditionExpression: aws.String("attribute_not_exists(#key) OR #counter = :condCounter AND #owner = :condOwner"),
 		})
-
-		if err == nil {
-			break
-		}
-
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
-			break
-		}
-
-		backoff := l.Backoff.Duration()
-
-		l.Logger.WithFields(logrus.Fields{
-			"backoff": backoff,
-			"attempt": int(l.Backoff.Attempt()),
-		}).Warnf("Worker %s failed to create lease", l.WorkerId)
-
-		time.Sleep(backoff)
-	}
-
-	l.Backoff.Reset()
+		return err
+	})
 
 	if err != nil {
-		return nil, err
+		return nil, wrapError("create", lease.Key, err, ErrLeaseExists)
 	}
 
 	// the ReturnValues argument can only be ALL_OLD or NONE, it means that
@@ -332,46 +505,146 @@ func (l *LeaseManager) CreateLease(lease *Lease) (*Lease, error) {
 	return lease, nil
 }
 
-// UpdateLease used to update only the extra fields on the Lease object.
+// UpdateLease used to update only the extra fields on the Lease object, and the
+// not-before time(if it's set). leases are completed only by CompleteLease.
 // With this method you will be able to update the task status, or any
 // other fields.
 // for example: {"status": "done", "last_update": "unix seconds"}
 // To add extra fields on a Lease, use Lease.Set(key, val)
+// To update extra fields atomically, use Lease.Incr, Lease.AppendList, Lease.AddToSet
+// and Lease.DeleteFromSet. the updated values are available on the returned lease.
+// Conditional on the lease existing in DynamoDB. Returns ErrLeaseNotFound if the condition fails.
 func (l *LeaseManager) UpdateLease(lease *Lease) (*Lease, error) {
+	input, err := l.updateInput(lease)
+	if input == nil || err != nil {
+		return lease, wrapError("update", lease.Key, err, nil)
+	}
+
+	// do not create partial leases
+	input.ExpressionAttributeNames["#key"] = aws.String(LeaseKeyKey)
+	input.ConditionExpression = aws.String("attribute_exists(#key)")
+
+	ulease, err := l.updateLease(input)
+	if err != nil {
+		return nil, wrapError("update", lease.Key, err, ErrLeaseNotFound)
+	}
+	return ulease, nil
+}
+
+// UpdateHeldLease is like UpdateLease, but it's conditional on the leaseOwner and the
+// leaseEpoch in DynamoDB matching the owner and the epoch of the input, so a worker
+// that lost the lease(even if it re-acquired it since) cannot override the fields
+// written by the current owner. the leaseCounter is not part of the condition, because
+// it's incremented on each renewal.
+// Returns ErrOwnershipLost if the condition fails.
+func (l *LeaseManager) UpdateHeldLease(lease *Lease) (*Lease, error) {
+	input, err := l.updateInput(lease)
+	if input == nil || err != nil {
+		return lease, wrapError("update", lease.Key, err, nil)
+	}
+	l.ownedCondition(input, lease)
+	ulease, err := l.updateLease(input)
+	if err != nil {
+		return nil, wrapError("update", lease.Key, err, ErrOwnershipLost)
+	}
+	return ulease, nil
+}
+
+// updateInput returns the input of UpdateLease and UpdateHeldLease, or nil if
+// there's nothing to update.
+func (l *LeaseManager) updateInput(lease *Lease) (*dynamodb.UpdateItemInput, error) {
 	var (
-		attExp     string
-		attVal     map[string]*dynamodb.AttributeValue
-		isReserved = func(w string) bool { return w == LeaseKeyKey || w == LeaseOwnerKey || w == LeaseCounterKey }
+		attExp  string
+		attName = make(map[string]*string)
+		attVal  = make(map[string]*dynamodb.AttributeValue)
+		setExp  []string
 	)
 
+	// the extra fields are referenced by placeholders(#n<i> and :v<i>), so they do not
+	// collide with reserved words, or with the placeholders of this package.
+	names := make(map[string]int)
+	name := func(k string) (string, string) {
+		i, ok := names[k]
+		if !ok {
+			i = len(names)
+			names[k] = i
+			attName[fmt.Sprintf("#n%d", i)] = aws.String(k)
+		}
+		return fmt.Sprintf("#n%d", i), fmt.Sprintf(":v%d", i)
+	}
+
 	// set fields
 	if len(lease.extrafields) > 0 || len(lease.explicitfields) > 0 {
 		item, err := l.Serializer.Encode(lease)
 		if err != nil {
-			return lease, err
+			return nil, err
+		}
+		keys := make([]string, 0, len(item))
+		for k := range item {
+			keys = append(keys, k)
 		}
-		setExp := make([]string, 0)
-		for k, v := range item {
-			if !isReserved(k) {
-				// if it's the first time we add entry to the map
-				if attVal == nil {
-					attVal = make(map[string]*dynamodb.AttributeValue)
-				}
-				setExp = append(setExp, fmt.Sprintf("%s = :%s", k, k))
-				attVal[":"+k] = v
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !isSchemaKey(k) {
+				n, v := name(k)
+				setExp = append(setExp, fmt.Sprintf("%s = %s", n, v))
+				attVal[v] = item[k]
 			}
 		}
-		if len(setExp) > 0 {
-			attExp += "SET " + strings.Join(setExp, ", ")
+	}
+
+	// reschedule the lease
+	if !lease.NotBefore.IsZero() {
+		setExp = append(setExp, "#notBefore = :notBefore")
+		attName["#notBefore"] = aws.String(LeaseNotBeforeKey)
+		attVal[":notBefore"] = encodeMills(lease.NotBefore)
+	}
+
+	// atomic updates
+	var addExp, delExp []string
+	keys := make([]string, 0, len(lease.updatedfields))
+	for k := range lease.updatedfields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if isSchemaKey(k) {
+			continue
+		}
+		u := lease.updatedfields[k]
+		n, v := name(k)
+		switch u.action {
+		case incr:
+			addExp = append(addExp, fmt.Sprintf("%s %s", n, v))
+			attVal[v] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(u.n))}
+		case appendList:
+			list, err := dynamodbattribute.Marshal(u.list)
+			if err != nil {
+				return nil, err
+			}
+			setExp = append(setExp, fmt.Sprintf("%s = list_append(if_not_exists(%s, :__emptyList), %s)", n, n, v))
+			attVal[":__emptyList"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+			attVal[v] = list
+		case addToSet:
+			addExp = append(addExp, fmt.Sprintf("%s %s", n, v))
+			attVal[v] = u.set
+		case deleteFromSet:
+			delExp = append(delExp, fmt.Sprintf("%s %s", n, v))
+			attVal[v] = u.set
 		}
 	}
 
+	if len(setExp) > 0 {
+		attExp += "SET " + strings.Join(setExp, ", ")
+	}
+
 	// remove fields
 	if len(lease.removedfields) > 0 {
 		rmExp := make([]string, 0)
 		for _, f := range lease.removedfields {
-			if !isReserved(f) {
-				rmExp = append(rmExp, f)
+			if !isSchemaKey(f) {
+				n, _ := name(f)
+				rmExp = append(rmExp, n)
 			}
 		}
 		if len(rmExp) > 0 {
@@ -379,12 +652,20 @@ func (l *LeaseManager) UpdateLease(lease *Lease) (*Lease, error) {
 		}
 	}
 
+	if len(addExp) > 0 {
+		attExp += " ADD " + strings.Join(addExp, ", ")
+	}
+	if len(delExp) > 0 {
+		attExp += " DELETE " + strings.Join(delExp, ", ")
+	}
+
 	// if there's nothing to update
 	if attExp == "" {
-		return lease, nil
+		return nil, nil
 	}
 
-	return l.updateLease(&dynamodb.UpdateItemInput{
+	// the conditions are added by the callers
+	return &dynamodb.UpdateItemInput{
 		TableName: aws.String(l.LeaseTable),
 		Key: map[string]*dynamodb.AttributeValue{
 			LeaseKeyKey: {
@@ -392,9 +673,205 @@ func (l *LeaseManager) UpdateLease(lease *Lease) (*Lease, error) {
 			},
 		},
 		UpdateExpression:          aws.String(attExp),
+		ExpressionAttributeNames:  attName,
 		ExpressionAttributeValues: attVal,
 		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	}, nil
+}
+
+// CheckpointLease writes the given checkpoint on the lease.
+// Conditional on the leaseOwner and the leaseEpoch in DynamoDB matching the owner and
+// the epoch of the input, so a worker that lost the lease(even if it re-acquired
+// it since) cannot override the checkpoint of the current owner.
+// Returns ErrOwnershipLost if the condition fails.
+// Mutates the checkpoint of the passed-in lease object after updating the record in DynamoDB.
+func (l *LeaseManager) CheckpointLease(lease *Lease, checkpoint string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(l.LeaseTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey: {
+				S: aws.String(lease.Key),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#checkpoint": aws.String(LeaseCheckpointKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":checkpoint": {
+				S: aws.String(checkpoint),
+			},
+		},
+		UpdateExpression: aws.String("SET #checkpoint = :checkpoint"),
+	}
+	if err := l.ownedUpdate(input, lease); err != nil {
+		return wrapError("checkpoint", lease.Key, err, ErrOwnershipLost)
+	}
+	lease.Checkpoint = checkpoint
+	return nil
+}
+
+// CompleteLease marks the lease as completed, and sets its owner to null(the
+// completer is remembered as the previous owner). completed leases are never
+// renewed or taken again.
+// Conditional on the leaseOwner and the leaseEpoch in DynamoDB matching the owner and
+// the epoch of the input. Returns ErrOwnershipLost if the condition fails.
+// Mutates the owner and the completion fields of the passed-in lease object after updating the record in DynamoDB.
+func (l *LeaseManager) CompleteLease(lease *Lease) error {
+	clease := *lease
+	clease.Owner = "NULL"
+	clease.PreviousOwner = lease.Owner
+	clease.Completed = true
+	clease.CompletedAt = time.Now()
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(l.LeaseTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey: {
+				S: aws.String(lease.Key),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#prevOwner":   aws.String(LeasePreviousOwnerKey),
+			"#completed":   aws.String(LeaseCompletedKey),
+			"#completedAt": aws.String(LeaseCompletedAtKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {
+				S: aws.String(clease.Owner),
+			},
+			":prevOwner": {
+				S: aws.String(clease.PreviousOwner),
+			},
+			":completed": {
+				BOOL: aws.Bool(true),
+			},
+			":completedAt": encodeMills(clease.CompletedAt),
+		},
+		UpdateExpression: aws.String("SET #owner = :owner, #prevOwner = :prevOwner, #completed = :completed, #completedAt = :completedAt"),
+	}
+	if err := l.ownedUpdate(input, lease); err != nil {
+		return wrapError("complete", lease.Key, err, ErrOwnershipLost)
+	}
+	*lease = clease
+	return nil
+}
+
+// ownedUpdate calls Client.Update with the given input, conditional on the leaseOwner
+// and the leaseEpoch in DynamoDB matching the owner and the epoch of the given lease.
+func (l *LeaseManager) ownedUpdate(input *dynamodb.UpdateItemInput, lease *Lease) error {
+	l.ownedCondition(input, lease)
+	_, err := l.updateItem(input)
+	return err
+}
+
+// ownedCondition adds a condition on the leaseOwner and the leaseEpoch in DynamoDB
+// matching the owner and the epoch of the given lease to the given input.
+func (l *LeaseManager) ownedCondition(input *dynamodb.UpdateItemInput, lease *Lease) {
+	input.ExpressionAttributeNames["#owner"] = aws.String(LeaseOwnerKey)
+	input.ExpressionAttributeNames["#epoch"] = aws.String(LeaseEpochKey)
+	input.ExpressionAttributeValues[":condOwner"] = &dynamodb.AttributeValue{
+		S: aws.String(lease.Owner),
+	}
+	// leases that were never taken(e.g: created by this worker) have no epoch.
+	if lease.Epoch > 0 {
+		input.ExpressionAttributeValues[":condEpoch"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(lease.Epoch)),
+		}
+		input.ConditionExpression = aws.String("#owner = :condOwner AND #epoch = :condEpoch")
+	} else {
+		input.ConditionExpression = aws.String("#owner = :condOwner AND attribute_not_exists(#epoch)")
+	}
+}
+
+// Heartbeat records that the given worker is alive by setting its last-seen
+// time(in unix milliseconds), its labels and zone in the workers table.
+// Mutates the LastSeen field of the passed-in worker object after updating the record in DynamoDB.
+func (l *LeaseManager) Heartbeat(worker *Worker) error {
+	cworker := *worker
+	cworker.LastSeen = time.Now()
+	err := l.retry(l.RetryPolicies.Update, "send heartbeat", func() error {
+		_, err := l.Client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(l.WorkerTable),
+			Item:      encodeWorker(&cworker),
+		})
+		return err
+	})
+	if err == nil {
+		worker.LastSeen = cworker.LastSeen
+	}
+	return wrapError("heartbeat", worker.Id, err, nil)
+}
+
+// ListWorkers returns all the workers stored in the workers table, including
+// the ones that stopped sending heartbeats.
+func (l *LeaseManager) ListWorkers() (list []Worker, err error) {
+	var res *dynamodb.ScanOutput
+	err = l.retry(l.RetryPolicies.Scan, "scan workers table", func() (err error) {
+		res, err = l.Client.Scan(&dynamodb.ScanInput{
+			TableName: aws.String(l.WorkerTable),
+		})
+		return
+	})
+	if err != nil {
+		return nil, wrapError("list workers", "", err, nil)
+	}
+	for _, item := range res.Items {
+		if worker, err := decodeWorker(item); err != nil {
+			l.Logger.WithError(err).Error("decode worker")
+		} else {
+			list = append(list, *worker)
+		}
+	}
+	return
+}
+
+// DeleteWorker deletes the heartbeat record of the given worker. does nothing
+// when passed a worker that does not exist in DynamoDB.
+func (l *LeaseManager) DeleteWorker(workerId string) error {
+	err := l.retry(l.RetryPolicies.Delete, "delete worker "+workerId, func() error {
+		_, err := l.Client.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(l.WorkerTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				WorkerIdKey: {
+					S: aws.String(workerId),
+				},
+			},
+		})
+		return err
+	})
+	return wrapError("delete worker", workerId, err, nil)
+}
+
+// RemoveExpiredWorker deletes the heartbeat record of the given worker, as it was
+// returned by ListWorkers.
+// Conditional on the lastSeen in DynamoDB matching the last-seen time of the input, so
+// a worker that sent a heartbeat since it was listed is not removed from the fleet.
+// Returns false if the condition fails.
+func (l *LeaseManager) RemoveExpiredWorker(worker *Worker) (bool, error) {
+	err := l.retry(l.RetryPolicies.Delete, "remove worker "+worker.Id, func() error {
+		_, err := l.Client.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(l.WorkerTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				WorkerIdKey: {
+					S: aws.String(worker.Id),
+				},
+			},
+			ExpressionAttributeNames: map[string]*string{
+				"#lastSeen": aws.String(WorkerLastSeenKey),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":observed": encodeMills(worker.LastSeen),
+			},
+			ConditionExpression: aws.String("#lastSeen = :observed"),
+		})
+		return err
 	})
+	if err == nil {
+		return true, nil
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
+		return false, nil
+	}
+	return false, wrapError("remove worker", worker.Id, err, nil)
 }
 
 // condLease gets a 2 Lease objects. the first one is for the update attributes
@@ -422,6 +899,25 @@ func (l *LeaseManager) condUpdate(updateLease, condLease Lease) (err error) {
 			LeaseCounterKey,
 		)),
 	}
+	if updateLease.PreviousOwner != condLease.PreviousOwner {
+		updateInput.ExpressionAttributeValues[":prevOwner"] = &dynamodb.AttributeValue{
+			S: aws.String(updateLease.PreviousOwner),
+		}
+		*updateInput.UpdateExpression += fmt.Sprintf(", %s = :prevOwner", LeasePreviousOwnerKey)
+	}
+	if updateLease.Epoch != condLease.Epoch {
+		updateInput.ExpressionAttributeValues[":epoch"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(updateLease.Epoch)),
+		}
+		*updateInput.UpdateExpression += fmt.Sprintf(", %s = :epoch", LeaseEpochKey)
+	}
+	if !updateLease.RenewedAt.Equal(condLease.RenewedAt) {
+		updateInput.ExpressionAttributeValues[":renewedAt"] = encodeMills(updateLease.RenewedAt)
+		*updateInput.UpdateExpression += fmt.Sprintf(", %s = :renewedAt", LeaseRenewedAtKey)
+	}
+	if updateLease.PendingOwner == "" && condLease.PendingOwner != "" {
+		*updateInput.UpdateExpression += fmt.Sprintf(" REMOVE %s", LeasePendingOwnerKey)
+	}
 
 	// add conditions only to veteran leases
 	var (
@@ -459,36 +955,123 @@ func (l *LeaseManager) condUpdate(updateLease, condLease Lease) (err error) {
 // use this method to reduce duplicate code.
 // if the operation success we serialize the response and return the result.
 func (l *LeaseManager) updateLease(input *dynamodb.UpdateItemInput) (*Lease, error) {
-	var (
-		err error
-		out *dynamodb.UpdateItemOutput
-	)
-	for l.Backoff.Attempt() < maxUpdateRetries {
+	out, err := l.updateItem(input)
+	if err != nil {
+		return nil, err
+	}
+	return l.Serializer.Decode(out.Attributes)
+}
+
+// updateItem gets updateInput and call Client.Update with the retries logic.
+// it does not retry on conditional failures(or other fatal errors).
+func (l *LeaseManager) updateItem(input *dynamodb.UpdateItemInput) (out *dynamodb.UpdateItemOutput, err error) {
+	err = l.retry(l.RetryPolicies.Update, "update item", func() (err error) {
 		out, err = l.Client.UpdateItem(input)
+		return
+	})
+	return
+}
 
-		if err == nil {
-			break
+// AcquireStealBudget reserves up to n steals from the cluster-wide steal budget.
+// The budget allows StealBudget ownership changes in each StealBudgetWindow(according
+// to the worker clock), and it's stored in the lease table under StealBudgetKey.
+// Returns the number of steals that were reserved, that may be less than n(or 0)
+// if the budget is exhausted.
+func (l *LeaseManager) AcquireStealBudget(n int) (int, error) {
+	window := time.Now().UnixNano() / int64(l.StealBudgetWindow)
+	for n = min(n, l.StealBudget); n > 0; n /= 2 {
+		ok, err := l.reserveStealBudget(window, n)
+		if err != nil {
+			return 0, wrapError("acquire steal budget", StealBudgetKey, err, nil)
 		}
-
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
-			break
+		if ok {
+			return n, nil
 		}
-
-		backoff := l.Backoff.Duration()
-
-		l.Logger.WithFields(logrus.Fields{
-			"backoff": backoff,
-			"attempt": int(l.Backoff.Attempt()),
-		}).Warnf("Worker %s failed to update lease", l.WorkerId)
-
-		time.Sleep(backoff)
 	}
+	return 0, nil
+}
 
-	l.Backoff.Reset()
+// ReleaseStealBudget returns n reserved steals that were not used(e.g: the take failed)
+// to the steal budget of the current window. does nothing if the steals were reserved
+// in a window that is over.
+func (l *LeaseManager) ReleaseStealBudget(n int) error {
+	window := time.Now().UnixNano() / int64(l.StealBudgetWindow)
+	_, err := l.updateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(l.LeaseTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey: {
+				S: aws.String(StealBudgetKey),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#window": aws.String(StealBudgetWindowKey),
+			"#count":  aws.String(StealBudgetCountKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":window": {
+				N: aws.String(strconv.FormatInt(window, 10)),
+			},
+			":n": {
+				N: aws.String(strconv.Itoa(n)),
+			},
+		},
+		UpdateExpression:    aws.String("SET #count = #count - :n"),
+		ConditionExpression: aws.String("#window = :window AND #count >= :n"),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
+		return nil
+	}
+	return wrapError("release steal budget", StealBudgetKey, err, nil)
+}
 
-	if err != nil {
-		return nil, err
+// reserveStealBudget tries to add n steals to the budget of the given window.
+// returns false if there's no room for n steals in this window.
+func (l *LeaseManager) reserveStealBudget(window int64, n int) (bool, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(l.LeaseTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey: {
+				S: aws.String(StealBudgetKey),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#window": aws.String(StealBudgetWindowKey),
+			"#count":  aws.String(StealBudgetCountKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":window": {
+				N: aws.String(strconv.FormatInt(window, 10)),
+			},
+			":n": {
+				N: aws.String(strconv.Itoa(n)),
+			},
+			":limit": {
+				N: aws.String(strconv.Itoa(l.StealBudget - n)),
+			},
+		},
+		// reserve in the current window
+		UpdateExpression:    aws.String("SET #count = #count + :n"),
+		ConditionExpression: aws.String("#window = :window AND #count <= :limit"),
+	}
+	_, err := l.updateItem(input)
+	if err == nil {
+		return true, nil
+	}
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != ConditionalFailed {
+		return false, err
 	}
 
-	return l.Serializer.Decode(out.Attributes)
+	// or start a new window
+	delete(input.ExpressionAttributeValues, ":limit")
+	input.ExpressionAttributeNames["#key"] = aws.String(LeaseKeyKey)
+	input.UpdateExpression = aws.String("SET #window = :window, #count = :n")
+	input.ConditionExpression = aws.String("attribute_not_exists(#key) OR #window < :window")
+	_, err = l.updateItem(input)
+	if err == nil {
+		return true, nil
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
+		return false, nil
+	}
+	return false, err
 }
@@ -3,7 +3,9 @@ package lease
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,7 +19,7 @@ func TestCreateTable(t *testing.T) {
 		methodCreateTable: {
 			// getting "already exists error"
 			awserr.New("ResourceInUseException", "", errors.New("")),
-			// getting error, should retry until maxCreateRetries
+			// getting error, should retry until RetryPolicies.CreateTable.MaxAttempts
 			nil, nil, nil,
 			// create table finished successfully
 			new(dynamodb.CreateTableOutput),
@@ -47,13 +49,14 @@ func TestListLeases(t *testing.T) {
 	client := newClientMock(map[method]args{
 		methodScan: {
 			// getting error from dynamodb
-			nil, nil, nil,
+			nil, errors.New("connection reset"), nil,
 			// scan table finished successfully
 			&dynamodb.ScanOutput{
 				Items: []map[string]*dynamodb.AttributeValue{
 					{"leaseKey": {S: aws.String("foo")}},
 					{"leaseKey": {S: aws.String("bar")}},
 					{"leaseKey": {S: aws.String("baz")}},
+					{"leaseKey": {S: aws.String(StealBudgetKey)}},
 				},
 			},
 		},
@@ -67,6 +70,7 @@ func TestListLeases(t *testing.T) {
 	leases, err = manager.ListLeases()
 	assert(t, err == nil, "expect not to fail when the request success")
 	assert(t, client.calls[methodScan] == 4, "number of calls should be 4")
+	assert(t, len(leases) == 3, "expect not to return the steal budget item")
 
 	expectedLeases := []string{"foo", "bar", "baz"}
 	for i := range leases {
@@ -94,6 +98,20 @@ func TestRenewLease(t *testing.T) {
 	assert(t, err != nil, "expect to returns the error")
 	assert(t, leaseToRenew.Counter == 11, "expect leaseCounter to be 11")
 	assert(t, client.calls[methodUpdateItem] == 3, "number of calls should be 3")
+	assert(t, leaseToRenew.RenewedAt.IsZero(), "expect not to write the renewal time by default")
+}
+
+func TestRenewLeaseWallClock(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {new(dynamodb.UpdateItemOutput)},
+	})
+	manager := newTestManager(client)
+	manager.WallClockExpiry = true
+
+	leaseToRenew := &Lease{Key: "foo", Counter: 10, Owner: "o1"}
+	err := manager.RenewLease(leaseToRenew)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, time.Since(leaseToRenew.RenewedAt) < time.Second, "expect to write the renewal time")
 }
 
 func TestEvictLease(t *testing.T) {
@@ -117,6 +135,7 @@ func TestEvictLease(t *testing.T) {
 	assert(t, err == nil, "expect not to fail")
 	assert(t, leaseToEvict.Counter == 10, "expect leaseCounter to be the same")
 	assert(t, leaseToEvict.Owner == "NULL", "expect leaseOwner to be the 'NULL'")
+	assert(t, leaseToEvict.PreviousOwner == "o1", "expect previousOwner to be the evicted owner")
 }
 
 func TestTakeLease(t *testing.T) {
@@ -139,6 +158,81 @@ func TestTakeLease(t *testing.T) {
 	assert(t, err == nil, "expect not to fail")
 	assert(t, leaseToTake.Owner == manager.WorkerId, "expect owner to equal workerId")
 	assert(t, leaseToTake.Counter == 11, "expect counter to be increment by 1")
+	assert(t, leaseToTake.Epoch == 1, "expect epoch to be increment by 1")
+	assert(t, leaseToTake.PreviousOwner == "o1", "expect previousOwner to be the last owner")
+}
+
+func TestCheckpointLease(t *testing.T) {
+	conditionalErr := awserr.New("ConditionalCheckFailedException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			new(dynamodb.UpdateItemOutput),
+			// the lease was taken by another worker
+			conditionalErr,
+		},
+	})
+	manager := newTestManager(client)
+
+	lease := &Lease{Key: "foo", Counter: 10, Owner: "1", Epoch: 2}
+	err := manager.CheckpointLease(lease, "100")
+	assert(t, err == nil, "expect not to fail")
+	assert(t, lease.Checkpoint == "100", "expect checkpoint to be set")
+
+	err = manager.CheckpointLease(lease, "200")
+	assert(t, errors.Is(err, ErrOwnershipLost), "expect to returns ErrOwnershipLost")
+	assert(t, lease.Checkpoint == "100", "expect checkpoint to be the same")
+	assert(t, client.calls[methodUpdateItem] == 2, "expect not retry on conditional failure")
+}
+
+func TestCompleteLease(t *testing.T) {
+	conditionalErr := awserr.New("ConditionalCheckFailedException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			// the lease was taken by another worker
+			conditionalErr,
+			new(dynamodb.UpdateItemOutput),
+		},
+	})
+	manager := newTestManager(client)
+
+	lease := &Lease{Key: "foo", Counter: 10, Owner: "1", Epoch: 2}
+	err := manager.CompleteLease(lease)
+	assert(t, errors.Is(err, ErrOwnershipLost), "expect to returns ErrOwnershipLost")
+	assert(t, lease.Owner == "1" && !lease.Completed, "expect lease to be the same")
+
+	err = manager.CompleteLease(lease)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, lease.hasNoOwner() && lease.PreviousOwner == "1", "expect completed lease to have no owner")
+	assert(t, lease.Completed && !lease.CompletedAt.IsZero(), "expect lease to be marked as completed")
+	assert(t, client.calls[methodUpdateItem] == 2, "expect number of calls to equal 2")
+}
+
+func TestHandoffLease(t *testing.T) {
+	conditionalErr := awserr.New("ConditionalCheckFailedException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			// the lease has another pending owner
+			conditionalErr,
+			new(dynamodb.UpdateItemOutput),
+			new(dynamodb.UpdateItemOutput),
+		},
+	})
+	manager := newTestManager(client)
+
+	lease := &Lease{Key: "foo", Counter: 10, Owner: "o1", Epoch: 2}
+	err := manager.RequestHandoff(lease)
+	assert(t, err != nil && lease.PendingOwner == "", "expect to returns the error")
+
+	err = manager.RequestHandoff(lease)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, lease.PendingOwner == manager.WorkerId && lease.Owner == "o1", "expect pendingOwner to equal workerId")
+
+	err = manager.HandoffLease(lease)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, lease.Owner == manager.WorkerId && lease.PendingOwner == "", "expect owner to be the pending owner")
+	assert(t, lease.PreviousOwner == "o1", "expect previousOwner to be the last owner")
+	assert(t, lease.Counter == 11 && lease.Epoch == 3, "expect counter and epoch to be increment by 1")
+	assert(t, client.calls[methodUpdateItem] == 3, "expect number of calls to equal 3")
 }
 
 func TestDeleteLease(t *testing.T) {
@@ -203,6 +297,284 @@ func TestCreateLease(t *testing.T) {
 	_, err = manager.CreateLease(leaseToCreate)
 	assert(t, err != nil, "expect CreateLease to fail")
 	assert(t, client.calls[methodPutItem] == 5, "expect CreateLease to retry 3 times")
+
+	_, err = manager.CreateLease(&Lease{Key: "baz", ExpireAfter: manager.ExpireAfter / 2})
+	assert(t, errors.Is(err, ErrInvalidExpiry), "expect CreateLease to reject expiry shorter than Config.ExpireAfter")
+	assert(t, client.calls[methodPutItem] == 5, "expect not to create lease with invalid expiry")
+}
+
+func TestHeartbeat(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodPutItem: {
+			// put item finished successfully
+			new(dynamodb.PutItemOutput),
+			// getting error from dynamodb
+			nil, nil,
+		},
+	})
+	manager := newTestManager(client)
+
+	worker := &Worker{Id: "foo", Labels: map[string]string{"zone": "a"}}
+	err := manager.Heartbeat(worker)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, client.calls[methodPutItem] == 1, "expect number of calls to equal 1")
+	assert(t, !worker.LastSeen.IsZero(), "expect to set the last-seen time")
+
+	lastSeen := worker.LastSeen
+	err = manager.Heartbeat(worker)
+	assert(t, err != nil, "expect to returns the error")
+	assert(t, client.calls[methodPutItem] == 3, "expect Heartbeat to retry 2 times")
+	assert(t, worker.LastSeen == lastSeen, "expect the last-seen time to be the same")
+}
+
+func TestRemoveExpiredWorker(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodDeleteItem: {
+			// delete item finished successfully
+			new(dynamodb.DeleteItemOutput),
+			// the worker sent a heartbeat since it was listed
+			awserr.New("ConditionalCheckFailedException", "", errors.New("")),
+		},
+	})
+	manager := newTestManager(client)
+
+	worker := &Worker{Id: "foo", LastSeen: time.Unix(1500000000, 0)}
+	ok, err := manager.RemoveExpiredWorker(worker)
+	assert(t, ok && err == nil, "expect to remove the worker")
+	assert(t, aws.StringValue(client.delete.ConditionExpression) == "#lastSeen = :observed", "expect to be conditional on the last-seen time")
+	assert(t, aws.StringValue(client.delete.ExpressionAttributeValues[":observed"].N) == "1500000000000", "expect the condition to be the observed last-seen time")
+
+	ok, err = manager.RemoveExpiredWorker(worker)
+	assert(t, !ok && err == nil, "expect not to remove a worker that sent a heartbeat")
+	assert(t, client.calls[methodDeleteItem] == 2, "expect not retry on conditional failure")
+}
+
+func TestListWorkers(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodScan: {
+			&dynamodb.ScanOutput{
+				Items: []map[string]*dynamodb.AttributeValue{
+					{"workerId": {S: aws.String("foo")}, "lastSeen": {N: aws.String("1500000000000")}},
+					{
+						"workerId": {S: aws.String("bar")},
+						"lastSeen": {N: aws.String("1500000001000")},
+						"labels":   {M: map[string]*dynamodb.AttributeValue{"zone": {S: aws.String("a")}}},
+					},
+					// invalid record
+					{"workerId": {S: aws.String("baz")}},
+				},
+			},
+		},
+	})
+	manager := newTestManager(client)
+
+	workers, err := manager.ListWorkers()
+	assert(t, err == nil, "expect not to fail")
+	assert(t, len(workers) == 2, "expect to skip the invalid record")
+	assert(t, workers[0].Id == "foo" && workers[0].LastSeen.Equal(time.Unix(1500000000, 0)), "expect to decode the first worker")
+	assert(t, workers[1].Id == "bar" && workers[1].LastSeen.Equal(time.Unix(1500000001, 0)), "expect to decode the second worker")
+	assert(t, len(workers[1].Labels) == 1 && workers[1].Labels["zone"] == "a", "expect to decode the worker labels")
+}
+
+func TestAcquireStealBudget(t *testing.T) {
+	conditionalErr := awserr.New("ConditionalCheckFailedException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			// reserve 3 in the current window
+			new(dynamodb.UpdateItemOutput),
+			// no room for 3 in the current window, and the window is not over.
+			conditionalErr, conditionalErr,
+			// reserve 1 in the current window
+			new(dynamodb.UpdateItemOutput),
+			// no room for 5 in the current window. start a new window
+			conditionalErr, new(dynamodb.UpdateItemOutput),
+		},
+	})
+	manager := newTestManager(client)
+	manager.StealBudget = 5
+
+	n, err := manager.AcquireStealBudget(3)
+	assert(t, err == nil && n == 3, "expect to reserve 3 steals")
+	assert(t, client.calls[methodUpdateItem] == 1, "expect number of calls to equal 1")
+
+	n, err = manager.AcquireStealBudget(3)
+	assert(t, err == nil && n == 1, "expect to reserve 1 steal")
+	assert(t, client.calls[methodUpdateItem] == 4, "expect number of calls to equal 4")
+
+	n, err = manager.AcquireStealBudget(10)
+	assert(t, err == nil && n == 5, "expect to reserve at most the budget")
+	assert(t, client.calls[methodUpdateItem] == 6, "expect number of calls to equal 6")
+}
+
+func TestReleaseStealBudget(t *testing.T) {
+	conditionalErr := awserr.New("ConditionalCheckFailedException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			// release in the current window
+			new(dynamodb.UpdateItemOutput),
+			// the window is over
+			conditionalErr,
+		},
+	})
+	manager := newTestManager(client)
+	manager.StealBudget = 5
+
+	err := manager.ReleaseStealBudget(2)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, aws.StringValue(client.update.UpdateExpression) == "SET #count = #count - :n", "expect to decrement the budget count")
+	assert(t, aws.StringValue(client.update.ExpressionAttributeValues[":n"].N) == "2", "expect to release 2 steals")
+
+	err = manager.ReleaseStealBudget(2)
+	assert(t, err == nil, "expect to ignore the release of a window that is over")
+	assert(t, client.calls[methodUpdateItem] == 2, "expect number of calls to equal 2")
+}
+
+func TestCreateChildLease(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodPutItem: {new(dynamodb.PutItemOutput), new(dynamodb.PutItemOutput)},
+	})
+	manager := newTestManager(client)
+
+	lease, err := manager.CreateLease(&Lease{Key: "baz", Parents: []string{"bar"}})
+	assert(t, err == nil, "expect CreateLease not to fail")
+	assert(t, lease.hasNoOwner() && lease.Counter == 1, "expect leases with parents to be created without owner")
+
+	lease, err = manager.CreateLease(&Lease{Key: "qux", NotBefore: time.Now().Add(time.Hour)})
+	assert(t, err == nil, "expect CreateLease not to fail")
+	assert(t, lease.hasNoOwner(), "expect scheduled leases to be created without owner")
+}
+
+func TestUpdateLease(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			new(dynamodb.UpdateItemOutput),
+			new(dynamodb.UpdateItemOutput),
+		},
+	})
+	manager := newTestManager(client)
+
+	_, err := manager.UpdateLease(&Lease{Key: "foo"})
+	assert(t, err == nil, "expect not to fail")
+	assert(t, client.calls[methodUpdateItem] == 0, "expect not to update when there's nothing to update")
+
+	lease := &Lease{Key: "foo"}
+	lease.Set("status", "done")
+	_, err = manager.UpdateLease(lease)
+	assert(t, err == nil, "expect not to fail")
+	assert(t, client.calls[methodUpdateItem] == 1, "expect to update the extra fields")
+
+	_, err = manager.UpdateLease(&Lease{Key: "foo", NotBefore: time.Now().Add(time.Minute)})
+	assert(t, err == nil, "expect not to fail")
+	assert(t, client.calls[methodUpdateItem] == 2, "expect to update the not-before time")
+}
+
+func TestUpdateLeaseAtomic(t *testing.T) {
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			&dynamodb.UpdateItemOutput{
+				Attributes: map[string]*dynamodb.AttributeValue{
+					"leaseKey": {
+						S: aws.String("foo"),
+					},
+					"count": {
+						N: aws.String("10"),
+					},
+				},
+			},
+			new(dynamodb.UpdateItemOutput),
+		},
+	})
+	manager := newTestManager(client)
+
+	lease := &Lease{Key: "foo"}
+	lease.Incr("count", 2)
+	lease.AppendList("list", "a")
+	lease.DeleteFromSet("set", []string{"a"}, StringSet)
+	ulease, err := manager.UpdateLease(lease)
+	assert(t, err == nil, "expect not to fail")
+
+	exp := aws.StringValue(client.update.UpdateExpression)
+	assert(t, exp == "SET #n1 = list_append(if_not_exists(#n1, :__emptyList), :v1) ADD #n0 :v0 DELETE #n2 :v2", "expect to compile the atomic updates")
+	names := client.update.ExpressionAttributeNames
+	assert(t, aws.StringValue(names["#n0"]) == "count" && aws.StringValue(names["#n1"]) == "list" && aws.StringValue(names["#n2"]) == "set",
+		"expect to escape the field names")
+	assert(t, aws.StringValue(client.update.ExpressionAttributeValues[":v0"].N) == "2", "expect to add the increment")
+	assert(t, len(client.update.ExpressionAttributeValues[":v1"].L) == 1, "expect to append the list values")
+	count, _ := ulease.Get("count")
+	assert(t, count == 10, "expect to return the updated values")
+
+	// fields that collide with reserved words, or with the placeholders of this package.
+	lease = &Lease{Key: "foo"}
+	lease.Set("emptyList", "a")
+	lease.AppendList("status", "b")
+	manager.UpdateLease(lease)
+	exp = aws.StringValue(client.update.UpdateExpression)
+	assert(t, exp == "SET #n0 = :v0, #n1 = list_append(if_not_exists(#n1, :__emptyList), :v1)", "expect to escape the fields")
+	values := client.update.ExpressionAttributeValues
+	assert(t, aws.StringValue(values[":v0"].S) == "a" && len(values[":__emptyList"].L) == 0, "expect not to override the empty list")
+}
+
+func TestUpdateHeldLease(t *testing.T) {
+	conditionalErr := awserr.New(ConditionalFailed, "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodUpdateItem: {
+			new(dynamodb.UpdateItemOutput),
+			// the lease was taken by another worker
+			conditionalErr,
+		},
+	})
+	manager := newTestManager(client)
+
+	lease := &Lease{Key: "foo", Counter: 10, Owner: "1", Epoch: 2}
+	lease.Set("status", "done")
+	_, err := manager.UpdateHeldLease(lease)
+	assert(t, err == nil, "expect not to fail")
+	cond := aws.StringValue(client.update.ConditionExpression)
+	assert(t, cond == "#owner = :condOwner AND #epoch = :condEpoch", "expect to be conditional on the owner and the epoch")
+	assert(t, aws.StringValue(client.update.ExpressionAttributeValues[":condOwner"].S) == "1", "expect the condition owner to be the lease owner")
+
+	_, err = manager.UpdateHeldLease(lease)
+	assert(t, errors.Is(err, ErrOwnershipLost), "expect to returns ErrOwnershipLost")
+	assert(t, client.calls[methodUpdateItem] == 2, "expect not retry on conditional failure")
+}
+
+func TestManagerErrors(t *testing.T) {
+	conditionalErr := awserr.New(ConditionalFailed, "", errors.New(""))
+	throttledErr := awserr.New("ProvisionedThroughputExceededException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodPutItem: {conditionalErr},
+		methodUpdateItem: {
+			conditionalErr,
+			conditionalErr,
+			throttledErr,
+		},
+		methodDeleteItem: {conditionalErr},
+	})
+	manager := newTestManager(client)
+	manager.RetryPolicies.Update.MaxThrottledAttempts = 1
+
+	_, err := manager.CreateLease(&Lease{Key: "foo"})
+	assert(t, errors.Is(err, ErrLeaseExists), "expect create to returns ErrLeaseExists")
+	assert(t, strings.HasPrefix(err.Error(), `leaser: create "foo": lease already exists`), "expect the error message to contain the operation and the key")
+	var lerr *Error
+	assert(t, errors.As(err, &lerr) && lerr.Op == "create" && lerr.Key == "foo", "expect the error to record the operation and the key")
+	var awsErr awserr.Error
+	assert(t, errors.As(err, &awsErr) && awsErr.Code() == ConditionalFailed, "expect the error to wrap the DynamoDB error")
+
+	lease := &Lease{Key: "foo"}
+	lease.Set("status", "done")
+	_, err = manager.UpdateLease(lease)
+	assert(t, errors.Is(err, ErrLeaseNotFound), "expect update to returns ErrLeaseNotFound")
+
+	err = manager.RenewLease(&Lease{Key: "foo", Owner: "1", Counter: 1})
+	assert(t, errors.Is(err, ErrOwnershipLost), "expect renew to returns ErrOwnershipLost")
+
+	err = manager.RenewLease(&Lease{Key: "foo", Owner: "1", Counter: 1})
+	assert(t, errors.Is(err, ErrThrottled), "expect renew to returns ErrThrottled")
+	assert(t, !errors.Is(err, ErrOwnershipLost), "expect throttling not to be reported as ownership lost")
+
+	err = manager.DeleteLease(&Lease{Key: "foo", Owner: "1"})
+	assert(t, errors.Is(err, ErrOwnershipLost), "expect delete to returns ErrOwnershipLost")
 }
 
 type (
@@ -215,10 +587,23 @@ const (
 	methodCreate = iota
 	methodLCreate
 	methodUpdate
+	methodUpdateHeld
 	methodDelete
 	methodRenew
 	methodEvict
 	methodTake
+	methodCheckpoint
+	methodComplete
+	methodRequestHandoff
+	methodHandoff
+	methodCancelHandoff
+	methodCreateWorker
+	methodHeartbeat
+	methodListWorkers
+	methodDeleteWorker
+	methodRemoveWorker
+	methodStealBudget
+	methodReleaseBudget
 	methodList
 
 	// Clientface methods
@@ -239,24 +624,40 @@ func (m method) String() string {
 }
 
 var methodNames = map[method]string{
-	methodCreate:        "CreateLeaseTable",
-	methodLCreate:       "CreateLease",
-	methodDelete:        "DeleteLease",
-	methodRenew:         "RenewLease",
-	methodEvict:         "EvictLease",
-	methodTake:          "TakeLease",
-	methodList:          "ListLeases",
-	methodScan:          "Scan",
-	methodPutItem:       "PutItem",
-	methodUpdateItem:    "UpdateItem",
-	methodDeleteItem:    "DeleteItem",
-	methodCreateTable:   "CreateTable",
-	methodDescribeTable: "DescribeTable",
+	methodCreate:         "CreateLeaseTable",
+	methodLCreate:        "CreateLease",
+	methodUpdate:         "UpdateLease",
+	methodUpdateHeld:     "UpdateHeldLease",
+	methodDelete:         "DeleteLease",
+	methodRenew:          "RenewLease",
+	methodEvict:          "EvictLease",
+	methodTake:           "TakeLease",
+	methodCheckpoint:     "CheckpointLease",
+	methodComplete:       "CompleteLease",
+	methodRequestHandoff: "RequestHandoff",
+	methodHandoff:        "HandoffLease",
+	methodCancelHandoff:  "CancelHandoff",
+	methodCreateWorker:   "CreateWorkerTable",
+	methodHeartbeat:      "Heartbeat",
+	methodListWorkers:    "ListWorkers",
+	methodDeleteWorker:   "DeleteWorker",
+	methodRemoveWorker:   "RemoveExpiredWorker",
+	methodStealBudget:    "AcquireStealBudget",
+	methodReleaseBudget:  "ReleaseStealBudget",
+	methodList:           "ListLeases",
+	methodScan:           "Scan",
+	methodPutItem:        "PutItem",
+	methodUpdateItem:     "UpdateItem",
+	methodDeleteItem:     "DeleteItem",
+	methodCreateTable:    "CreateTable",
+	methodDescribeTable:  "DescribeTable",
 }
 
 type clientMock struct {
-	calls  map[method]int  // method name: call times
-	result map[method]args // expected behavior
+	calls  map[method]int            // method name: call times
+	result map[method]args           // expected behavior
+	update *dynamodb.UpdateItemInput // last update input
+	delete *dynamodb.DeleteItemInput // last delete input
 }
 
 func newClientMock(behavior map[method]args) *clientMock {
@@ -275,14 +676,18 @@ func (c *clientMock) mcalled(name method) int {
 	return c.calls[name]
 }
 
-func (c *clientMock) Scan(*dynamodb.ScanInput) (out *dynamodb.ScanOutput, err error) {
+func (c *clientMock) Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
 	i := c.mcalled(methodScan)
-	if v := c.result[methodScan][i-1]; v != nil {
-		out = v.(*dynamodb.ScanOutput)
-	} else {
-		err = errors.New("scan failed")
+	result := c.result[methodScan][i-1]
+	if result != nil {
+		out, ok := result.(*dynamodb.ScanOutput)
+		if ok {
+			return out, nil
+		}
+		// allows custom errors. for example: 'ProvisionedThroughputExceeded'
+		return nil, result.(error)
 	}
-	return
+	return nil, errors.New("scan failed")
 }
 
 func (c *clientMock) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
@@ -294,13 +699,13 @@ func (c *clientMock) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, e
 			return out, nil
 		}
 		// allows custom errors. for example: 'ConditionalFailed'
-		err, ok := result.(awserr.Error)
-		return nil, err
+		return nil, result.(error)
 	}
 	return nil, errors.New("put item failed")
 }
 
-func (c *clientMock) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+func (c *clientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	c.update = input
 	i := c.mcalled(methodUpdateItem)
 	result := c.result[methodUpdateItem][i-1]
 	if result != nil {
@@ -309,13 +714,13 @@ func (c *clientMock) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItem
 			return out, nil
 		}
 		// allows custom errors. for example: 'ConditionalFailed'
-		err, ok := result.(awserr.Error)
-		return nil, err
+		return nil, result.(error)
 	}
 	return nil, errors.New("update item failed")
 }
 
-func (c *clientMock) DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+func (c *clientMock) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	c.delete = input
 	i := c.mcalled(methodDeleteItem)
 	result := c.result[methodDeleteItem][i-1]
 	if result != nil {
@@ -324,8 +729,7 @@ func (c *clientMock) DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItem
 			return out, nil
 		}
 		// allows custom errors. for example: 'ConditionalFailed'
-		err, ok := result.(awserr.Error)
-		return nil, err
+		return nil, result.(error)
 	}
 	return nil, errors.New("delete item failed")
 }
@@ -339,8 +743,7 @@ func (c *clientMock) CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTa
 			return out, nil
 		}
 		// allows custom errors. for example: 'ConditionalFailed'
-		err, ok := result.(awserr.Error)
-		return nil, err
+		return nil, result.(error)
 	}
 	return nil, errors.New("create table failed")
 }
@@ -354,29 +757,36 @@ func (c *clientMock) DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.Desc
 			return out, nil
 		}
 		// allows custom errors. for example: 'ConditionalFailed'
-		err, ok := result.(awserr.Error)
-		return nil, err
+		return nil, result.(error)
 	}
 	return nil, errors.New("describe table failed")
 }
 
-func newTestManager(client Clientface) *LeaseManager {
+// newTestLogger returns a logger that does not log the test runs.
+func newTestLogger() *logrus.Logger {
 	logger := logrus.New()
 	logger.Level = logrus.PanicLevel
+	return logger
+}
+
+func newTestManager(client Clientface) *LeaseManager {
 	config := &Config{
 		WorkerId:   "1",
 		LeaseTable: "test",
-		Logger:     logger,
+		Logger:     newTestLogger(),
 		Client:     client,
-		Backoff:    &Backoff{b: &backoff.Backoff{Min: 0, Max: 0}},
+		BackoffFactory: func() Backofface {
+			return &Backoff{b: &backoff.Backoff{Min: 0, Max: 0}}
+		},
 	}
 	config.defaults()
 	return &LeaseManager{config, newSerializer()}
 }
 
 type managerMock struct {
-	calls  map[method]int  // method name: call times
-	result map[method]args // expected behavior
+	calls    map[method]int  // method name: call times
+	result   map[method]args // expected behavior
+	released int             // released steal budget
 }
 
 func newManagerMock(behavior map[method]args) *managerMock {
@@ -421,6 +831,14 @@ func (m *managerMock) UpdateLease(l *Lease) (*Lease, error) {
 	return l, m.errOnly(methodUpdate)
 }
 
+// UpdateHeldLease returns the updated lease with a new concurrency token, like
+// the lease decoded from the DynamoDB response.
+func (m *managerMock) UpdateHeldLease(l *Lease) (*Lease, error) {
+	ulease := *l
+	ulease.concurrencyToken, _ = uuid()
+	return &ulease, m.errOnly(methodUpdateHeld)
+}
+
 func (m *managerMock) RenewLease(*Lease) error {
 	return m.errOnly(methodRenew)
 }
@@ -434,6 +852,89 @@ func (m *managerMock) EvictLease(l *Lease) error {
 	return m.errOnly(methodEvict)
 }
 
+func (m *managerMock) CheckpointLease(l *Lease, checkpoint string) (err error) {
+	if err = m.errOnly(methodCheckpoint); err == nil {
+		l.Checkpoint = checkpoint
+	}
+	return
+}
+
+func (m *managerMock) CompleteLease(l *Lease) (err error) {
+	if err = m.errOnly(methodComplete); err == nil {
+		l.Owner, l.Completed, l.CompletedAt = "NULL", true, time.Now()
+	}
+	return
+}
+
+func (m *managerMock) RequestHandoff(l *Lease) (err error) {
+	if err = m.errOnly(methodRequestHandoff); err == nil {
+		l.PendingOwner = "1"
+	}
+	return
+}
+
+func (m *managerMock) HandoffLease(l *Lease) (err error) {
+	if err = m.errOnly(methodHandoff); err == nil {
+		l.Owner, l.PendingOwner = l.PendingOwner, ""
+	}
+	return
+}
+
+func (m *managerMock) CancelHandoff(l *Lease) (err error) {
+	if err = m.errOnly(methodCancelHandoff); err == nil {
+		l.PendingOwner = ""
+	}
+	return
+}
+
+func (m *managerMock) CreateWorkerTable() error {
+	return m.errOnly(methodCreateWorker)
+}
+
+func (m *managerMock) Heartbeat(*Worker) error {
+	return m.errOnly(methodHeartbeat)
+}
+
+func (m *managerMock) DeleteWorker(string) error {
+	return m.errOnly(methodDeleteWorker)
+}
+
+func (m *managerMock) RemoveExpiredWorker(*Worker) (bool, error) {
+	err := m.errOnly(methodRemoveWorker)
+	return err == nil, err
+}
+
+func (m *managerMock) AcquireStealBudget(n int) (int, error) {
+	i := m.mcalled(methodStealBudget)
+	switch v := m.result[methodStealBudget][i-1].(type) {
+	case int:
+		return min(n, v), nil
+	case error:
+		return 0, v
+	}
+	return 0, nil
+}
+
+func (m *managerMock) ReleaseStealBudget(n int) error {
+	m.mcalled(methodReleaseBudget)
+	m.released += n
+	return nil
+}
+
+// ListWorkers returns no workers if the behavior was not stubbed, to keep
+// the lease-only test cases simple.
+func (m *managerMock) ListWorkers() (workers []Worker, err error) {
+	i := m.mcalled(methodListWorkers)
+	if behavior, ok := m.result[methodListWorkers]; ok {
+		if v := behavior[i-1]; v != nil {
+			workers = v.([]Worker)
+		} else {
+			err = errors.New("list workers failed")
+		}
+	}
+	return
+}
+
 func (m *managerMock) ListLeases() (leases []*Lease, err error) {
 	i := m.mcalled(methodList)
 	if v := m.result[methodList][i-1]; v != nil {
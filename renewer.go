@@ -3,6 +3,7 @@ package lease
 import (
 	"strings"
 	"sync"
+	"time"
 )
 
 // Renewer used by the LeaseCoordinator to renew leases held by the system.
@@ -11,6 +12,7 @@ import (
 type Renewer interface {
 	Renew() error
 	GetHeldLeases() []Lease
+	SetCheckpoint(key, checkpoint string)
 }
 
 // leaseHolder is the default implementation of Renewer that uses DynamoDB
@@ -52,16 +54,55 @@ func (l *leaseHolder) Renew() error {
 			strings.Join(lostLeases, ", "))
 	}
 
-	// remove all the leases that stoled from this worker, or renew the leases
-	// that we still hold.
+	// remove all the leases that stoled from this worker(or completed), or renew
+	// the leases that we still hold. the held leases that need to be released are
+	// released after the renewal pass, so OnHandoff does not delay the renewals.
+	var releases []release
+	live := l.liveWorkers(leases)
 	for _, lease := range leases {
-		if lease.Owner == l.WorkerId {
+		if lease.Owner == l.WorkerId && !lease.Completed {
 			// if we took this lease and it's not holds by this renewer
 			l.Lock()
+			if held, ok := l.heldLeases[lease.Key]; ok {
+				lease.acquiredAt = held.acquiredAt
+				lease.lastRenewal = held.lastRenewal
+			} else {
+				lease.acquiredAt = time.Now()
+				lease.lastRenewal = time.Time{}
+			}
 			l.heldLeases[lease.Key] = lease
 			l.Unlock()
+			// another worker asked for this lease. if the heartbeats are not available,
+			// the lease is renewed and handed off on the next run.
+			if lease.PendingOwner != "" && live != nil {
+				if live[lease.PendingOwner] {
+					releases = append(releases, release{lease, l.manager.HandoffLease, "handed off"})
+				} else if err := l.manager.CancelHandoff(lease); err != nil {
+					l.Logger.Debugf("Worker %s could not cancel handoff of lease with key %s", l.WorkerId, lease.Key)
+				} else {
+					l.Logger.Debugf("Worker %s canceled handoff of lease with key %s to dead worker %s",
+						l.WorkerId, lease.Key, lease.PendingOwner)
+					lease.lastRenewal = time.Now()
+				}
+				continue
+			}
+			// or it was rescheduled to a future time.
+			if lease.isScheduled() {
+				releases = append(releases, release{lease, l.manager.EvictLease, "rescheduled"})
+				continue
+			}
+			// or we held it for too long.
+			if d := lease.maxHoldDuration(l.MaxHoldDuration); d > 0 && time.Since(lease.acquiredAt) > d {
+				releases = append(releases, release{lease, l.manager.EvictLease, "reached max hold duration"})
+				continue
+			}
+			if !l.renewalDue(lease) {
+				continue
+			}
 			if err := l.manager.RenewLease(lease); err != nil {
 				l.Logger.Debugf("Worker %s could not renew lease with key %s", l.WorkerId, lease.Key)
+			} else {
+				lease.lastRenewal = time.Now()
 			}
 		} else {
 			if _, ok := l.heldLeases[lease.Key]; ok {
@@ -72,6 +113,9 @@ func (l *leaseHolder) Renew() error {
 			}
 		}
 	}
+	for _, r := range releases {
+		l.release(r.lease, r.fn, r.reason)
+	}
 
 	// print the currently held leases belongs to this worker.
 	if keys := l.keys(); len(keys) > 0 {
@@ -80,6 +124,68 @@ func (l *leaseHolder) Renew() error {
 	return nil
 }
 
+// renewalDue returns true if the given held lease must be renewed in this run.
+// leases are renewed at least 3 times in their expiry, so leases with longer
+// expiry than Config.ExpireAfter are not renewed in each run.
+func (l *leaseHolder) renewalDue(lease *Lease) bool {
+	return lease.lastRenewal.IsZero() ||
+		time.Since(lease.lastRenewal)+l.RenewerInterval >= lease.expireAfter(l.ExpireAfter)/3
+}
+
+// release is a held lease that needs to be released in the current run, and the
+// function that releases it.
+type release struct {
+	lease  *Lease
+	fn     func(*Lease) error
+	reason string
+}
+
+// liveWorkers returns the workers that sent a heartbeat within ExpireAfter, if one of
+// the given leases is held by this worker and has a pending owner. It returns nil
+// if there's no pending handoff, or if the workers could not be listed.
+func (l *leaseHolder) liveWorkers(leases []*Lease) map[string]bool {
+	pending := false
+	for _, lease := range leases {
+		if lease.Owner == l.WorkerId && lease.PendingOwner != "" {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return nil
+	}
+	workers, err := l.manager.ListWorkers()
+	if err != nil {
+		l.Logger.WithError(err).Debugf("Worker %s could not list workers, postpone the handoffs", l.WorkerId)
+		return nil
+	}
+	live := make(map[string]bool)
+	for _, w := range workers {
+		if !w.isExpired(l.ExpireAfter) {
+			live[w.Id] = true
+		}
+	}
+	return live
+}
+
+// Release the given held lease using the given release function(e.g: hand it off to
+// the worker that asked for it). OnHandoff is called while the lease is still held,
+// and the lease is removed from the held leases before it's released. If the release
+// fails, the lease is held again on the next run of Renew() if we still own it.
+func (l *leaseHolder) release(lease *Lease, fn func(*Lease) error, reason string) {
+	if l.OnHandoff != nil {
+		l.OnHandoff(*lease)
+	}
+	l.Lock()
+	delete(l.heldLeases, lease.Key)
+	l.Unlock()
+	if err := fn(lease); err != nil {
+		l.Logger.Warnf("Worker %s failed to release lease with key %s(%s): %v", l.WorkerId, lease.Key, reason, err)
+	} else {
+		l.Logger.Debugf("Worker %s released lease with key %s: %s", l.WorkerId, lease.Key, reason)
+	}
+}
+
 // Returns currently held leases.
 // A lease is currently held if we successfully renewed it on the last
 // run of Renew()
@@ -93,6 +199,17 @@ func (l *leaseHolder) GetHeldLeases() (leases []Lease) {
 	return
 }
 
+// SetCheckpoint sets the checkpoint of the held lease with the given key(if it's
+// held), after it was written to DynamoDB. so GetHeldLeases(and OnHandoff) see the
+// last checkpoint before the next run of Renew().
+func (l *leaseHolder) SetCheckpoint(key, checkpoint string) {
+	l.Lock()
+	defer l.Unlock()
+	if lease, ok := l.heldLeases[key]; ok {
+		lease.Checkpoint = checkpoint
+	}
+}
+
 // keys return all worker's leases
 func (l *leaseHolder) keys() (keys []string) {
 	for k := range l.heldLeases {
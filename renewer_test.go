@@ -1,9 +1,15 @@
 package lease
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
 type renewerTest struct {
@@ -118,18 +124,120 @@ var renewerTestCases = []renewerTest{
 		},
 		[]Lease{},
 	},
+	{
+		"we holds 2 leases, but 1 was completed. expect to renew 1",
+		map[string]*Lease{
+			lease2.Key: lease2,
+			lease3.Key: lease3,
+		},
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: lease2.Key, Owner: renewerId, Completed: true},
+				lease3,
+			}},
+			methodRenew: {nil},
+		},
+		map[method]int{
+			methodList:  1,
+			methodRenew: 1,
+		},
+		[]Lease{*lease3},
+	},
+	{
+		"we holds 2 leases, and another worker asked for 1. expect to hand off 1 and renew 1",
+		map[string]*Lease{
+			lease2.Key: lease2,
+			lease3.Key: lease3,
+		},
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: lease2.Key, Owner: renewerId, PendingOwner: "3"},
+				lease3,
+			}},
+			methodListWorkers: {[]Worker{{Id: "3", LastSeen: time.Now()}}},
+			methodHandoff:     {nil},
+			methodRenew:       {nil},
+		},
+		map[method]int{
+			methodList:        1,
+			methodListWorkers: 1,
+			methodHandoff:     1,
+			methodRenew:       1,
+		},
+		[]Lease{*lease3},
+	},
+	{
+		"we holds 2 leases, and a dead worker asked for 1. expect to cancel the handoff of 1 and renew 1",
+		map[string]*Lease{
+			lease2.Key: lease2,
+			lease3.Key: lease3,
+		},
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: lease2.Key, Owner: renewerId, PendingOwner: "3"},
+				lease3,
+			}},
+			methodListWorkers:   {[]Worker{{Id: "3", LastSeen: time.Now().Add(-time.Hour)}}},
+			methodCancelHandoff: {nil},
+			methodRenew:         {nil},
+		},
+		map[method]int{
+			methodList:          1,
+			methodListWorkers:   1,
+			methodCancelHandoff: 1,
+			methodHandoff:       0,
+			methodRenew:         1,
+		},
+		[]Lease{*lease2, *lease3},
+	},
+	{
+		"we holds 2 leases, another worker asked for 1, but the workers are not available. expect to renew 2",
+		map[string]*Lease{
+			lease2.Key: lease2,
+			lease3.Key: lease3,
+		},
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: lease2.Key, Owner: renewerId, PendingOwner: "3"},
+				lease3,
+			}},
+			methodListWorkers: {nil},
+			methodRenew:       {nil, nil},
+		},
+		map[method]int{
+			methodList:        1,
+			methodListWorkers: 1,
+			methodHandoff:     0,
+			methodRenew:       2,
+		},
+		[]Lease{*lease2, *lease3},
+	},
+	{
+		"we holds 2 leases, and 1 was rescheduled to a future time. expect to release 1 and renew 1",
+		map[string]*Lease{
+			lease2.Key: lease2,
+			lease3.Key: lease3,
+		},
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: lease2.Key, Owner: renewerId, NotBefore: time.Now().Add(time.Hour)},
+				lease3,
+			}},
+			methodEvict: {nil},
+			methodRenew: {nil},
+		},
+		map[method]int{
+			methodList:  1,
+			methodEvict: 1,
+			methodRenew: 1,
+		},
+		[]Lease{*lease3},
+	},
 }
 
 func TestRenewerCases(t *testing.T) {
 	for _, test := range renewerTestCases {
-		logger := logrus.New()
-		logger.Level = logrus.PanicLevel
-		manager := newManagerMock(test.managerBehavior)
-		holder := &leaseHolder{
-			Config:     &Config{WorkerId: renewerId, Logger: logger},
-			manager:    manager,
-			heldLeases: test.prevState,
-		}
+		holder, manager := newTestHolder(test.managerBehavior, test.prevState)
 		holder.Renew()
 		// test method calls expectations
 		for method, calls := range test.expectedCalls {
@@ -157,3 +265,194 @@ func TestRenewerCases(t *testing.T) {
 		}
 	}
 }
+
+// newTestHolder returns a lease holder with the test config, that uses a manager mock
+// with the given behavior, and holds the given leases(if they're set). tests adjust
+// the config before they call Renew.
+func newTestHolder(behavior map[method]args, heldLeases map[string]*Lease) (*leaseHolder, *managerMock) {
+	if heldLeases == nil {
+		heldLeases = make(map[string]*Lease)
+	}
+	manager := newManagerMock(behavior)
+	return &leaseHolder{
+		Config: &Config{
+			WorkerId:        renewerId,
+			Logger:          newTestLogger(),
+			ExpireAfter:     10 * time.Second,
+			RenewerInterval: 10 * time.Second / 3,
+		},
+		manager:    manager,
+		heldLeases: heldLeases,
+	}, manager
+}
+
+func TestRenewerMaxHoldDuration(t *testing.T) {
+	newList := func() []*Lease {
+		return []*Lease{
+			&Lease{Key: "foo", Owner: renewerId},
+			&Lease{Key: "bar", Owner: renewerId, MaxHoldDuration: time.Hour},
+		}
+	}
+	holder, manager := newTestHolder(map[method]args{
+		methodList:  {newList(), newList()},
+		methodRenew: {nil, nil, nil},
+		methodEvict: {nil},
+	}, nil)
+	var released []string
+	holder.MaxHoldDuration = time.Minute
+	holder.OnHandoff = func(l Lease) { released = append(released, l.Key) }
+
+	holder.Renew()
+	assert(t, manager.calls[methodRenew] == 2, "expect to renew the leases")
+	assert(t, len(holder.GetHeldLeases()) == 2, "expect to hold the leases")
+
+	// we held the leases for longer than the config-wide max hold duration.
+	for _, lease := range holder.heldLeases {
+		lease.acquiredAt = time.Now().Add(-2 * time.Minute)
+	}
+	holder.Renew()
+	assert(t, manager.calls[methodEvict] == 1, "expect to release the lease that reached its max hold duration")
+	assert(t, manager.calls[methodRenew] == 3, "expect to renew the lease with a longer max hold duration")
+	assert(t, len(released) == 1 && released[0] == "foo", "expect to call OnHandoff before releasing the lease")
+	leases := holder.GetHeldLeases()
+	assert(t, len(leases) == 1 && leases[0].Key == "bar", "expect to stop holding the released lease")
+}
+
+func TestRenewerExpireAfter(t *testing.T) {
+	newList := func() []*Lease {
+		return []*Lease{
+			&Lease{Key: "foo", Owner: renewerId},
+			&Lease{Key: "bar", Owner: renewerId, ExpireAfter: time.Hour},
+		}
+	}
+	holder, manager := newTestHolder(map[method]args{
+		methodList:  {newList(), newList()},
+		methodRenew: {nil, nil, nil},
+	}, nil)
+
+	holder.Renew()
+	assert(t, manager.calls[methodRenew] == 2, "expect to renew new held leases immediately")
+
+	holder.Renew()
+	assert(t, manager.calls[methodRenew] == 3, "expect not to renew the lease with longer expiry in each run")
+	assert(t, len(holder.GetHeldLeases()) == 2, "expect to hold the leases")
+}
+
+func TestRenewerCheckpoint(t *testing.T) {
+	holder, manager := newTestHolder(map[method]args{
+		methodList:       {[]*Lease{&Lease{Key: "foo", Owner: renewerId}}},
+		methodRenew:      {nil},
+		methodCheckpoint: {nil},
+	}, nil)
+	coordinator := &Coordinator{Config: holder.Config, Manager: manager, Renewer: holder}
+
+	holder.Renew()
+	lease := holder.GetHeldLeases()[0]
+	_, err := coordinator.Checkpoint(lease, "100")
+	assert(t, err == nil, "expect not to fail")
+	assert(t, holder.GetHeldLeases()[0].Checkpoint == "100", "expect the held lease to have the new checkpoint")
+}
+
+func TestRenewerUpdate(t *testing.T) {
+	holder, manager := newTestHolder(map[method]args{
+		methodList:       {[]*Lease{&Lease{Key: "foo", Owner: renewerId, concurrencyToken: "token"}}},
+		methodRenew:      {nil},
+		methodUpdateHeld: {nil, nil},
+	}, nil)
+	coordinator := &Coordinator{Config: holder.Config, Manager: manager, Renewer: holder}
+
+	holder.Renew()
+	lease := holder.GetHeldLeases()[0]
+	lease.Incr("processed", 100)
+	lease, err := coordinator.Update(lease)
+	assert(t, err == nil, "expect not to fail")
+	lease.Incr("processed", 100)
+	_, err = coordinator.Update(lease)
+	assert(t, err == nil, "expect the updated lease to keep the concurrency token")
+}
+
+// warnLogger records the warnings logged by the tested component.
+type warnLogger struct {
+	*logrus.Logger
+	warnings []string
+}
+
+func (l *warnLogger) Warnf(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestRenewerHandoffFailure(t *testing.T) {
+	newList := func() []*Lease {
+		return []*Lease{&Lease{Key: "foo", Owner: renewerId, PendingOwner: "2"}}
+	}
+	holder, manager := newTestHolder(map[method]args{
+		methodList:        {newList(), newList()},
+		methodListWorkers: {[]Worker{{Id: "2", LastSeen: time.Now()}}, []Worker{{Id: "2", LastSeen: time.Now()}}},
+		methodHandoff:     {errors.New("handoff failed"), nil},
+	}, nil)
+	var handoffs int
+	logger := &warnLogger{Logger: newTestLogger()}
+	holder.Logger = logger
+	holder.OnHandoff = func(Lease) { handoffs++ }
+
+	holder.Renew()
+	assert(t, manager.calls[methodHandoff] == 1, "expect to hand off the lease")
+	assert(t, handoffs == 1, "expect to call OnHandoff before handing off the lease")
+	assert(t, len(logger.warnings) == 1, "expect to log the failed handoff")
+	assert(t, len(holder.GetHeldLeases()) == 0, "expect not to hold the lease while it's handed off")
+
+	// we still own the lease, so the handoff is retried.
+	holder.Renew()
+	assert(t, manager.calls[methodHandoff] == 2, "expect to retry the handoff")
+	assert(t, handoffs == 2, "expect to call OnHandoff again")
+	assert(t, len(logger.warnings) == 1, "expect not to log the successful handoff as a warning")
+}
+
+func TestRenewerThrottled(t *testing.T) {
+	client := &throttlingClient{keys: []string{"foo", "bar", "baz"}, throttled: "foo", updates: make(map[string]int)}
+	manager := newTestManager(client)
+	manager.RenewerInterval = 300 * time.Millisecond
+	manager.RetryPolicies = RetryPolicies{}
+	manager.RetryPolicies.defaults(manager.Config)
+	holder := &leaseHolder{
+		Config:     manager.Config,
+		manager:    manager,
+		heldLeases: make(map[string]*Lease),
+	}
+
+	start := time.Now()
+	holder.Renew()
+	assert(t, time.Since(start) < 2*manager.RenewerInterval, "expect the throttled renewal not to stall the Renewer")
+	assert(t, client.updates["foo"] > 1, "expect to retry the throttled renewal")
+	assert(t, client.updates["bar"] == 1 && client.updates["baz"] == 1, "expect to renew the other leases")
+}
+
+// throttlingClient is a Clientface that lists the leases with the given keys(held
+// by the test manager), and throttles the updates of one of them.
+type throttlingClient struct {
+	Clientface
+	keys      []string
+	throttled string
+	updates   map[string]int
+}
+
+func (c *throttlingClient) Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	out := new(dynamodb.ScanOutput)
+	for _, key := range c.keys {
+		out.Items = append(out.Items, map[string]*dynamodb.AttributeValue{
+			LeaseKeyKey:     {S: aws.String(key)},
+			LeaseOwnerKey:   {S: aws.String("1")},
+			LeaseCounterKey: {N: aws.String("1")},
+		})
+	}
+	return out, nil
+}
+
+func (c *throttlingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	key := aws.StringValue(input.Key[LeaseKeyKey].S)
+	c.updates[key]++
+	if key == c.throttled {
+		return nil, awserr.New("ProvisionedThroughputExceededException", "", errors.New(""))
+	}
+	return new(dynamodb.UpdateItemOutput), nil
+}
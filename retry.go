@@ -0,0 +1,186 @@
+package lease
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// RetryPolicy determines how a failed DynamoDB operation is retried. Operations
+// that fail with a fatal error(e.g: ValidationException, or a conditional failure)
+// are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of the operation, when it
+	// fails with a transient error(e.g: InternalServerError, or a network error).
+	MaxAttempts int
+
+	// MaxThrottledAttempts is the maximum number of attempts of the operation,
+	// when it's throttled(e.g: ProvisionedThroughputExceededException). defaults to 10.
+	MaxThrottledAttempts int
+
+	// MaxElapsedTime is the maximum time to spend on the operation, including the
+	// backoff between the attempts. no attempt is made after this time.
+	MaxElapsedTime time.Duration
+
+	// MaxThrottledElapsedTime is like MaxElapsedTime, when the operation is throttled.
+	// defaults to 2m(long enough for MaxThrottledAttempts with the default backoff), except
+	// for the Scan and Update policies that are used by the Renewer.
+	MaxThrottledElapsedTime time.Duration
+}
+
+// RetryPolicies holds the RetryPolicy of each DynamoDB operation.
+type RetryPolicies struct {
+	// Scan of the leases and the workers tables. defaults to 3 attempts within ExpireAfter,
+	// when it's throttled as well.
+	Scan RetryPolicy
+	// Update of leases, and heartbeats. defaults to 2 attempts within RenewerInterval, when
+	// it's throttled as well. so a throttled renewal does not delay the renewal of the other
+	// held leases beyond their expiry.
+	Update RetryPolicy
+	// Create of leases. defaults to 3 attempts within ExpireAfter.
+	Create RetryPolicy
+	// Delete of leases and workers. defaults to 2 attempts within ExpireAfter.
+	Delete RetryPolicy
+	// CreateTable of the leases and the workers tables. defaults to 3 attempts within 1m.
+	CreateTable RetryPolicy
+}
+
+// defaults sets the default values of the unset fields of each policy.
+func (r *RetryPolicies) defaults(c *Config) {
+	r.Scan.defaults(3, c.ExpireAfter, c.ExpireAfter)
+	r.Update.defaults(2, c.RenewerInterval, c.RenewerInterval)
+	r.Create.defaults(3, c.ExpireAfter, 2*time.Minute)
+	r.Delete.defaults(2, c.ExpireAfter, 2*time.Minute)
+	r.CreateTable.defaults(3, time.Minute, 2*time.Minute)
+}
+
+// policies returns the policies and their field names, in the order of the fields.
+func (r *RetryPolicies) policies() (names []string, policies []RetryPolicy) {
+	return []string{"Scan", "Update", "Create", "Delete", "CreateTable"},
+		[]RetryPolicy{r.Scan, r.Update, r.Create, r.Delete, r.CreateTable}
+}
+
+// defaults sets the default values of the unset fields of the policy.
+func (p *RetryPolicy) defaults(attempts int, elapsed, throttledElapsed time.Duration) {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = attempts
+	}
+	if p.MaxThrottledAttempts == 0 {
+		p.MaxThrottledAttempts = 10
+	}
+	if p.MaxElapsedTime == 0 {
+		p.MaxElapsedTime = elapsed
+	}
+	if p.MaxThrottledElapsedTime == 0 {
+		p.MaxThrottledElapsedTime = throttledElapsed
+	}
+}
+
+// errorClass is the retry class of an error.
+type errorClass int
+
+const (
+	// transient errors are retried up to MaxAttempts.
+	errTransient errorClass = iota
+	// throttled errors are retried up to MaxThrottledAttempts.
+	errThrottled
+	// fatal errors are never retried.
+	errFatal
+)
+
+// AWS error codes, by their retry class. unknown errors are considered transient.
+var (
+	throttledCodes = map[string]bool{
+		"ProvisionedThroughputExceededException": true,
+		"ThrottlingException":                    true,
+		"Throttling":                             true,
+		"RequestLimitExceeded":                   true,
+		"TooManyRequestsException":               true,
+	}
+	fatalCodes = map[string]bool{
+		ConditionalFailed:                          true,
+		AlreadyExist:                               true,
+		"ValidationException":                      true,
+		"ResourceNotFoundException":                true,
+		"AccessDeniedException":                    true,
+		"UnrecognizedClientException":              true,
+		"MissingAuthenticationTokenException":      true,
+		"ItemCollectionSizeLimitExceededException": true,
+		"LimitExceededException":                   true,
+		"SerializationException":                   true,
+	}
+)
+
+// classify returns the retry class of the given error.
+func classify(err error) errorClass {
+	awsErr, ok := err.(awserr.Error)
+	switch {
+	case !ok:
+		return errTransient
+	case throttledCodes[awsErr.Code()]:
+		return errThrottled
+	case fatalCodes[awsErr.Code()]:
+		return errFatal
+	}
+	return errTransient
+}
+
+// wrapError wraps the given error with the operation and the key it failed on. a
+// conditional failure is reported as condErr(if it's set), and a throttled error as
+// ErrThrottled.
+func wrapError(op, key string, err, condErr error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	e := &Error{Op: op, Key: key, Err: err}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ConditionalFailed {
+		e.Kind = condErr
+	} else if classify(err) == errThrottled {
+		e.Kind = ErrThrottled
+	}
+	return e
+}
+
+// retry calls fn until it succeeds, fails with a fatal error, or until the given
+// policy gives up. the last error is returned. the op string used for logging.
+// each call gets its own backoff from the BackoffFactory.
+func (l *LeaseManager) retry(p RetryPolicy, op string, fn func() error) (err error) {
+	b := l.BackoffFactory()
+	defer b.Reset()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			break
+		}
+
+		class := classify(err)
+		if class == errFatal {
+			break
+		}
+		limit, elapsed := p.MaxAttempts, p.MaxElapsedTime
+		if class == errThrottled {
+			limit, elapsed = p.MaxThrottledAttempts, p.MaxThrottledElapsedTime
+		}
+		if attempt >= limit {
+			break
+		}
+
+		backoff := b.Duration()
+		if time.Since(start)+backoff > elapsed {
+			break
+		}
+
+		l.Logger.WithFields(logrus.Fields{
+			"backoff":   backoff,
+			"attempt":   attempt,
+			"throttled": class == errThrottled,
+		}).Warnf("Worker %s failed to %s", l.WorkerId, op)
+
+		time.Sleep(backoff)
+	}
+	return
+}
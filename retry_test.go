@@ -0,0 +1,168 @@
+package lease
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class errorClass
+	}{
+		{errors.New("connection reset"), errTransient},
+		{awserr.New("InternalServerError", "", nil), errTransient},
+		{awserr.New("ProvisionedThroughputExceededException", "", nil), errThrottled},
+		{awserr.New("ThrottlingException", "", nil), errThrottled},
+		{awserr.New("ValidationException", "", nil), errFatal},
+		{awserr.New("ResourceNotFoundException", "", nil), errFatal},
+		{awserr.New(ConditionalFailed, "", nil), errFatal},
+	}
+	for _, test := range tests {
+		assert(t, classify(test.err) == test.class, "unexpected class for error: "+test.err.Error())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	throttled := awserr.New("ProvisionedThroughputExceededException", "", errors.New(""))
+	client := newClientMock(map[method]args{
+		methodScan: {
+			// throttled more than MaxAttempts
+			throttled, throttled, throttled, throttled, &dynamodb.ScanOutput{},
+			// fatal error
+			awserr.New("ResourceNotFoundException", "", errors.New("")),
+		},
+	})
+	manager := newTestManager(client)
+
+	_, err := manager.ListLeases()
+	assert(t, err == nil, "expect to retry throttled scans up to MaxThrottledAttempts")
+	assert(t, client.calls[methodScan] == 5, "expect number of calls to equal 5")
+
+	_, err = manager.ListLeases()
+	assert(t, err != nil, "expect to returns the error")
+	assert(t, client.calls[methodScan] == 6, "expect not to retry fatal errors")
+}
+
+func TestRetryMaxElapsedTime(t *testing.T) {
+	manager := newTestManager(newClientMock(nil))
+	calls := 0
+	err := manager.retry(RetryPolicy{MaxAttempts: 10, MaxThrottledAttempts: 10, MaxElapsedTime: time.Millisecond}, "test", func() error {
+		calls++
+		time.Sleep(time.Millisecond)
+		return errors.New("failed")
+	})
+	assert(t, err != nil, "expect to returns the error")
+	assert(t, calls == 1, "expect not to retry after MaxElapsedTime")
+}
+
+func TestRetryThrottledDefaults(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.PanicLevel
+	config := &Config{LeaseTable: "test", Logger: logger, Client: newClientMock(nil)}
+	config.defaults()
+	policies := config.RetryPolicies
+	// the policies used by the Renewer are bounded by its interval and the lease expiry.
+	assert(t, policies.Update.MaxThrottledElapsedTime <= config.RenewerInterval,
+		"expect throttled updates not to delay the Renewer beyond its interval")
+	assert(t, policies.Scan.MaxThrottledElapsedTime <= config.ExpireAfter,
+		"expect throttled scans not to delay the Renewer beyond the lease expiry")
+	for name, p := range map[string]RetryPolicy{"Create": policies.Create, "Delete": policies.Delete, "CreateTable": policies.CreateTable} {
+		// the backoff between the throttled attempts, without jitter.
+		var elapsed time.Duration
+		b := config.BackoffFactory().(*Backoff)
+		b.b.Jitter = false
+		for attempt := 1; attempt < p.MaxThrottledAttempts; attempt++ {
+			elapsed += b.Duration()
+		}
+		assert(t, elapsed <= p.MaxThrottledElapsedTime,
+			"expect "+name+" to retry throttled errors up to MaxThrottledAttempts with the default timings")
+	}
+}
+
+func TestRetryThrottledElapsedTime(t *testing.T) {
+	throttled := awserr.New("ProvisionedThroughputExceededException", "", errors.New(""))
+	manager := newTestManager(newClientMock(nil))
+	policy := RetryPolicy{MaxAttempts: 2, MaxThrottledAttempts: 3, MaxElapsedTime: time.Millisecond, MaxThrottledElapsedTime: time.Minute}
+	calls := 0
+	err := manager.retry(policy, "test", func() error {
+		calls++
+		return throttled
+	})
+	assert(t, err != nil, "expect to returns the error")
+	assert(t, calls == 3, "expect throttled errors to use their own time budget")
+}
+
+func TestBackoffPerCall(t *testing.T) {
+	client := &failingClient{}
+	manager := newTestManager(client)
+	manager.RetryPolicies.Update = RetryPolicy{MaxAttempts: 5, MaxThrottledAttempts: 5, MaxElapsedTime: time.Minute}
+	var (
+		mu       sync.Mutex
+		backoffs []*countingBackoff
+	)
+	manager.BackoffFactory = func() Backofface {
+		b := &countingBackoff{}
+		mu.Lock()
+		backoffs = append(backoffs, b)
+		mu.Unlock()
+		return b
+	}
+
+	// concurrent renewals, that all fail.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			manager.RenewLease(&Lease{Key: strconv.Itoa(i), Owner: "1", Counter: 1})
+		}(i)
+	}
+	wg.Wait()
+
+	assert(t, client.calls == 50, "expect each call to make all its attempts")
+	assert(t, len(backoffs) == 10, "expect each call to get its own backoff")
+	for _, b := range backoffs {
+		assert(t, b.attempts == 4 && b.resets == 1, "expect each call to have an independent retry sequence")
+	}
+}
+
+// failingClient is a concurrency-safe Clientface that fails all the updates.
+type failingClient struct {
+	Clientface
+	sync.Mutex
+	calls int
+}
+
+func (c *failingClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	c.Lock()
+	c.calls++
+	c.Unlock()
+	return nil, errors.New("update item failed")
+}
+
+// countingBackoff counts the attempts and the resets of a backoff.
+type countingBackoff struct {
+	attempts int
+	resets   int
+}
+
+func (b *countingBackoff) Duration() time.Duration {
+	b.attempts++
+	return time.Duration(b.attempts) * time.Microsecond
+}
+
+func (b *countingBackoff) Attempt() float64 {
+	return float64(b.attempts)
+}
+
+func (b *countingBackoff) Reset() {
+	b.resets++
+}
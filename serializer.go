@@ -1,6 +1,7 @@
 package lease
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
@@ -25,7 +26,7 @@ type serializer struct {
 
 func newSerializer() Serializer {
 	return &serializer{
-		schemakeys: []string{LeaseKeyKey, LeaseOwnerKey, LeaseCounterKey},
+		schemakeys: schemaKeys,
 	}
 }
 
@@ -35,6 +36,46 @@ func (s *serializer) Decode(item map[string]*dynamodb.AttributeValue) (*Lease, e
 		return nil, err
 	}
 
+	if v := item[LeaseCompletedAtKey]; v != nil && v.N != nil {
+		t, err := decodeMills(v)
+		if err != nil {
+			return nil, err
+		}
+		lease.CompletedAt = t
+	}
+
+	if v := item[LeaseNotBeforeKey]; v != nil && v.N != nil {
+		t, err := decodeMills(v)
+		if err != nil {
+			return nil, err
+		}
+		lease.NotBefore = t
+	}
+
+	if v := item[LeaseMaxHoldKey]; v != nil && v.N != nil {
+		d, err := decodeDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		lease.MaxHoldDuration = d
+	}
+
+	if v := item[LeaseExpireAfterKey]; v != nil && v.N != nil {
+		d, err := decodeDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		lease.ExpireAfter = d
+	}
+
+	if v := item[LeaseRenewedAtKey]; v != nil && v.N != nil {
+		t, err := decodeMills(v)
+		if err != nil {
+			return nil, err
+		}
+		lease.RenewedAt = t
+	}
+
 	lease.lastRenewal = time.Now()
 	lease.concurrencyToken, _ = uuid()
 
@@ -75,6 +116,72 @@ func (s *serializer) Encode(lease *Lease) (map[string]*dynamodb.AttributeValue,
 		},
 	}
 
+	if lease.Epoch > 0 {
+		item[LeaseEpochKey] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(lease.Epoch)),
+		}
+	}
+
+	if lease.Checkpoint != "" {
+		item[LeaseCheckpointKey] = &dynamodb.AttributeValue{
+			S: aws.String(lease.Checkpoint),
+		}
+	}
+
+	if len(lease.Requirements) > 0 {
+		item[LeaseRequirementsKey] = encodeLabels(lease.Requirements)
+	}
+
+	if len(lease.Parents) > 0 {
+		item[LeaseParentsKey] = &dynamodb.AttributeValue{
+			SS: aws.StringSlice(lease.Parents),
+		}
+	}
+
+	if lease.Completed {
+		item[LeaseCompletedKey] = &dynamodb.AttributeValue{
+			BOOL: aws.Bool(lease.Completed),
+		}
+	}
+
+	if !lease.CompletedAt.IsZero() {
+		item[LeaseCompletedAtKey] = encodeMills(lease.CompletedAt)
+	}
+
+	if !lease.NotBefore.IsZero() {
+		item[LeaseNotBeforeKey] = encodeMills(lease.NotBefore)
+	}
+
+	if !lease.RenewedAt.IsZero() {
+		item[LeaseRenewedAtKey] = encodeMills(lease.RenewedAt)
+	}
+
+	if lease.MaxHoldDuration > 0 {
+		item[LeaseMaxHoldKey] = encodeDuration(lease.MaxHoldDuration)
+	}
+
+	if lease.ExpireAfter > 0 {
+		item[LeaseExpireAfterKey] = encodeDuration(lease.ExpireAfter)
+	}
+
+	if lease.Priority != 0 {
+		item[LeasePriorityKey] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.Itoa(lease.Priority)),
+		}
+	}
+
+	if lease.PendingOwner != "" {
+		item[LeasePendingOwnerKey] = &dynamodb.AttributeValue{
+			S: aws.String(lease.PendingOwner),
+		}
+	}
+
+	if lease.PreviousOwner != "" {
+		item[LeasePreviousOwnerKey] = &dynamodb.AttributeValue{
+			S: aws.String(lease.PreviousOwner),
+		}
+	}
+
 	// make sure we remove the keys that belog to this package
 	// and avoid unwanted behavior
 	for _, k := range s.schemakeys {
@@ -99,3 +206,97 @@ func (s *serializer) Encode(lease *Lease) (map[string]*dynamodb.AttributeValue,
 
 	return item, nil
 }
+
+// encodeWorker serializes the provided Worker object to dynamodb item.
+// the last-seen time is stored in unix milliseconds.
+func encodeWorker(worker *Worker) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		WorkerIdKey: {
+			S: aws.String(worker.Id),
+		},
+		WorkerLastSeenKey: encodeMills(worker.LastSeen),
+	}
+	if len(worker.Labels) > 0 {
+		item[WorkerLabelsKey] = encodeLabels(worker.Labels)
+	}
+	if worker.Zone != "" {
+		item[WorkerZoneKey] = &dynamodb.AttributeValue{
+			S: aws.String(worker.Zone),
+		}
+	}
+	return item
+}
+
+// decodeWorker convert the provided dynamodb item to Worker object.
+func decodeWorker(item map[string]*dynamodb.AttributeValue) (*Worker, error) {
+	id, lastSeen := item[WorkerIdKey], item[WorkerLastSeenKey]
+	if id == nil || id.S == nil || lastSeen == nil || lastSeen.N == nil {
+		return nil, errors.New("leaser: missing worker attributes")
+	}
+	t, err := decodeMills(lastSeen)
+	if err != nil {
+		return nil, err
+	}
+	worker := &Worker{
+		Id:       *id.S,
+		LastSeen: t,
+		Labels:   decodeLabels(item[WorkerLabelsKey]),
+	}
+	if zone := item[WorkerZoneKey]; zone != nil {
+		worker.Zone = aws.StringValue(zone.S)
+	}
+	return worker, nil
+}
+
+// encodeMills serializes the provided time to dynamodb number in unix milliseconds.
+func encodeMills(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)),
+	}
+}
+
+// decodeMills convert the provided dynamodb number in unix milliseconds to time.
+func decodeMills(v *dynamodb.AttributeValue) (time.Time, error) {
+	mills, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, mills*int64(time.Millisecond)), nil
+}
+
+// encodeDuration serializes the provided duration to dynamodb number in milliseconds.
+func encodeDuration(d time.Duration) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(int64(d/time.Millisecond), 10)),
+	}
+}
+
+// decodeDuration convert the provided dynamodb number in milliseconds to duration.
+func decodeDuration(v *dynamodb.AttributeValue) (time.Duration, error) {
+	mills, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(mills) * time.Millisecond, nil
+}
+
+// encodeLabels serializes the provided labels to dynamodb map.
+func encodeLabels(labels map[string]string) *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(labels))
+	for k, v := range labels {
+		m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+// decodeLabels convert the provided dynamodb map to labels.
+func decodeLabels(v *dynamodb.AttributeValue) map[string]string {
+	if v == nil || len(v.M) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(v.M))
+	for k, v := range v.M {
+		labels[k] = aws.StringValue(v.S)
+	}
+	return labels
+}
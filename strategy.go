@@ -0,0 +1,416 @@
+package lease
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// Strategy is the interface that wraps the balancing policy of the Taker.
+// In each taking cycle, the Taker builds a View of the cluster and asks the
+// Strategy which leases it should try to take.
+//
+// Choose returns the leases to take(expired or unowned) and the leases to
+// steal from other workers. All returned leases must be part of the view,
+// and the Taker will try to take them in the order they returned.
+//
+// Strategy implementations should not modify the leases in the view.
+type Strategy interface {
+	Choose(*View) (take, steal []*Lease)
+}
+
+// View is the state of the cluster as seen by the Taker on its last scan.
+type View struct {
+	// WorkerId of the worker that runs the Taker.
+	WorkerId string
+
+	// Leases holds all the leases in the table that this worker is eligible
+	// to take(i.e: their requirements match its labels), by their keys.
+	Leases map[string]*Lease
+
+	// Workers holds the live workers that are eligible to take at least one
+	// of the leases in the view, including this worker.
+	Workers map[string]Worker
+
+	// LeaseCounts holds the number of leases each live worker holds, including
+	// this worker and idle workers(with zero leases). Leases that are being handed
+	// off are counted for their pending owner.
+	LeaseCounts map[string]int
+
+	// Expired holds the leases that were expired as of the last scan, or
+	// that have no owner.
+	Expired []*Lease
+
+	// Released holds the workers that recently released leases after their max hold
+	// duration, by the keys of the leases. these workers are not eligible to take the
+	// leases they released.
+	Released map[string]string
+
+	// MaxLeasesToSteal is the maximum number of leases to steal at one time.
+	MaxLeasesToSteal int
+
+	// MinHoldDuration, StealCooldown and StealHysteresis are the anti-thrash
+	// settings from the Config. use CanSteal to test a lease against them
+	// and MaxStealPriority.
+	MinHoldDuration time.Duration
+	StealCooldown   time.Duration
+	StealHysteresis int
+
+	// MaxStealPriority is the maximum priority of a lease that can be stolen.
+	MaxStealPriority int
+
+	// Logger is the Taker logger.
+	Logger Logger
+}
+
+// Eligible returns the live workers in the view that are eligible to take the given
+// lease. owners of leases that do not send heartbeats(e.g: dead workers), and the
+// worker that recently released the lease are never eligible.
+func (v *View) Eligible(lease *Lease) []string {
+	workers := make([]string, 0, len(v.Workers))
+	for id, worker := range v.Workers {
+		if lease.matches(worker.Labels) && v.Released[lease.Key] != id {
+			workers = append(workers, id)
+		}
+	}
+	return workers
+}
+
+// mostOverloadedZone returns the zone that holds the largest excess of leases
+// over its share, according to the given lease counts. The share of each zone is
+// proportional to the number of workers in it. Returns an empty string if no zone
+// holds more than its share, or if the workers do not declare zones.
+func (v *View) mostOverloadedZone(leaseCounts map[string]int) (zone string) {
+	var (
+		total   int
+		workers = make(map[string]int)
+		leases  = make(map[string]int)
+	)
+	for worker, count := range leaseCounts {
+		z := v.Workers[worker].Zone
+		workers[z]++
+		leases[z] += count
+		total += count
+	}
+	// compare leases[z]/total to workers[z]/len(LeaseCounts) without division.
+	maxExcess := 0
+	for z := range workers {
+		if z == "" {
+			continue
+		}
+		if excess := leases[z]*len(leaseCounts) - total*workers[z]; excess > maxExcess {
+			zone, maxExcess = z, excess
+		}
+	}
+	return
+}
+
+// CanSteal returns true if the given lease can be stolen from its owner. i.e: its
+// priority is not above MaxStealPriority, the owner held it for at least MinHoldDuration,
+// it was not stolen in the last StealCooldown(as observed by the Taker), and it's not
+// being handed off to another worker.
+func (v *View) CanSteal(lease *Lease) bool {
+	if lease.PendingOwner != "" {
+		return false
+	}
+	if lease.Priority > v.MaxStealPriority || time.Since(lease.acquiredAt) < v.MinHoldDuration {
+		return false
+	}
+	return lease.stolenAt.IsZero() || time.Since(lease.stolenAt) >= v.StealCooldown
+}
+
+// BalancedStrategy is the default Strategy. It tries to reach an even number
+// of leases per worker:
+//
+// 1) Compute the target for each worker: numLeases / numWorkers (+1 if numWorkers doesn't evenly divide numLeases).
+// 2) If we need to take leases, take random expired leases. if there are no expired leases, consider
+// stealing from the over-loaded workers.
+//
+// Leases are taken in priority order(higher first), and stolen in reverse priority order. Within
+// the same priority, leases that were previously owned by this worker are preferred, so warm local
+// state can be reused after restarts.
+type BalancedStrategy struct{}
+
+// Choose implements the Strategy interface.
+func (s *BalancedStrategy) Choose(v *View) (take, steal []*Lease) {
+	numWorkers := len(v.LeaseCounts)
+	// assuming numLeases <= numWorkers
+	target := 1
+	// our target for each worker is numLeases / numWorkers (+1 if numWorkers doesn't evenly divide numLeases)
+	if len(v.Leases) > numWorkers {
+		target = len(v.Leases) / numWorkers
+		if len(v.Leases)%numWorkers != 0 {
+			target++
+		}
+	}
+
+	myCount := v.LeaseCounts[v.WorkerId]
+	numToReachTarget := target - myCount
+
+	if numToReachTarget <= 0 {
+		v.Logger.Debugf("Worker %s does not need to take leases. we have %d, and the target is: %d",
+			v.WorkerId,
+			myCount,
+			target)
+		return nil, nil
+	}
+
+	if len(v.Expired) > 0 {
+		expiredLeases := make([]*Lease, len(v.Expired))
+		copy(expiredLeases, v.Expired)
+		// shuffle expiredLeases so workers don't all try to contend for the same leases,
+		// but take higher priority leases first, and prefer the leases that we previously
+		// owned within the same priority.
+		shuffle(expiredLeases)
+		preferOwnedBy(expiredLeases, v.WorkerId)
+		sortByPriority(expiredLeases, true)
+		take = expiredLeases[:min(numToReachTarget, len(expiredLeases))]
+	} else {
+		v.Logger.Debugf("Worker %s needed %d leases but none were expired. consider stealing",
+			v.WorkerId,
+			numToReachTarget)
+		steal = s.chooseLeasesToSteal(v, numToReachTarget, target)
+	}
+
+	if n := len(take) + len(steal); n > 0 {
+		v.Logger.Debugf("Worker %s saw %d total leases, %d available leases, %d workers.\n"+
+			"Target is %d leases, I have %d leases, I plan to take %d leases, I will take %d leases",
+			v.WorkerId,
+			len(v.Leases),
+			len(v.Expired),
+			numWorkers,
+			target,
+			myCount,
+			numToReachTarget,
+			n)
+	}
+
+	return take, steal
+}
+
+// Choose leases to steal by randomly selecting one or more (up to max) from the over-loaded workers.
+//
+// Steal up to maxLeasesToStealAtOneTime leases, one lease at a time from the most loaded worker
+// (considering the leases we already chose to steal) while
+// 1. he has > target leases and I need >= 1 leases : steal 1 and continue
+// 2. he has == target leases, I need > 1 leases and I didn't choose any lease yet : steal 1 and stop
+//
+// That way, steals are spread across all workers that are over target, and a new worker converges
+// in fewer cycles. Workers are skipped if the difference between their lease count and ours is not
+// above StealHysteresis, and leases are skipped if CanSteal returns false. If the workers declare zones, the most loaded worker is picked from the most
+// over-represented zone.
+func (s *BalancedStrategy) chooseLeasesToSteal(v *View, needed, target int) (steal []*Lease) {
+	// leaseCounts after the steals we chose so far
+	leaseCounts := make(map[string]int, len(v.LeaseCounts))
+	for worker, count := range v.LeaseCounts {
+		leaseCounts[worker] = count
+	}
+	candidates := make(map[string][]*Lease)
+	for _, lease := range v.Leases {
+		if !lease.hasNoOwner() && lease.Owner != v.WorkerId && v.CanSteal(lease) {
+			candidates[lease.Owner] = append(candidates[lease.Owner], lease)
+		}
+	}
+	// steal lower priority leases first.
+	for worker := range candidates {
+		shuffle(candidates[worker])
+		preferOwnedBy(candidates[worker], v.WorkerId)
+		sortByPriority(candidates[worker], false)
+	}
+
+	// workers we can't steal from, because all their leases are protected.
+	exhausted := make(map[string]bool)
+	for len(steal) < min(needed, v.MaxLeasesToSteal) {
+		mostLoadedWorker := s.mostLoadedWorker(v, leaseCounts, target, exhausted)
+		count := leaseCounts[mostLoadedWorker]
+		if mostLoadedWorker != "" && len(candidates[mostLoadedWorker]) == 0 {
+			v.Logger.Debugf("Worker %s can not steal from worker %s. all his leases are protected.",
+				v.WorkerId,
+				mostLoadedWorker)
+			exhausted[mostLoadedWorker] = true
+			continue
+		}
+		// steal 1 if we need > 1 and max loaded worker has target leases.
+		stealOne := count == target && needed > 1 && len(steal) == 0
+		if count <= target && !stealOne || count-leaseCounts[v.WorkerId] <= v.StealHysteresis {
+			v.Logger.Debugf("Worker %s not stealing from most loaded worker %s.\n"+
+				"He has %d, target is %d, and I need %d.",
+				v.WorkerId,
+				mostLoadedWorker,
+				count,
+				target,
+				needed-len(steal))
+			break
+		}
+
+		v.Logger.Debugf("Worker %s will attempt to steal a lease from most loaded worker %s.\n"+
+			"He has %d leases, target is %d, and I need %d.",
+			v.WorkerId,
+			mostLoadedWorker,
+			count,
+			target,
+			needed-len(steal))
+
+		steal = append(steal, candidates[mostLoadedWorker][0])
+		candidates[mostLoadedWorker] = candidates[mostLoadedWorker][1:]
+		leaseCounts[mostLoadedWorker]--
+		leaseCounts[v.WorkerId]++
+		if stealOne {
+			break
+		}
+	}
+	return
+}
+
+// mostLoadedWorker returns the worker(other than this worker and the exhausted workers)
+// with the most leases according to the given lease counts. If there's a zone that holds more than its
+// share of leases, returns the most loaded worker in that zone that has at least
+// target leases.
+func (s *BalancedStrategy) mostLoadedWorker(v *View, leaseCounts map[string]int, target int, exhausted map[string]bool) string {
+	var mostLoadedWorker string
+	for worker, count := range leaseCounts {
+		if worker == v.WorkerId || exhausted[worker] {
+			continue
+		}
+		if mostLoadedWorker == "" || leaseCounts[mostLoadedWorker] < count {
+			mostLoadedWorker = worker
+		}
+	}
+
+	zone := v.mostOverloadedZone(leaseCounts)
+	if zone == "" {
+		return mostLoadedWorker
+	}
+
+	var zoneWorker string
+	for worker, count := range leaseCounts {
+		if worker == v.WorkerId || exhausted[worker] || v.Workers[worker].Zone != zone || count < target {
+			continue
+		}
+		if zoneWorker == "" || leaseCounts[zoneWorker] < count {
+			zoneWorker = worker
+		}
+	}
+	if zoneWorker == "" {
+		return mostLoadedWorker
+	}
+
+	v.Logger.Debugf("Worker %s prefers to steal from worker %s in over-represented zone %s",
+		v.WorkerId,
+		zoneWorker,
+		zone)
+	return zoneWorker
+}
+
+// sortByPriority sorts the leases by their priority(descending or ascending), and
+// keeps the order of leases with the same priority.
+func sortByPriority(list []*Lease, desc bool) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return list[i].Priority > list[j].Priority
+		}
+		return list[i].Priority < list[j].Priority
+	})
+}
+
+// preferOwnedBy moves the leases that the given worker owned before to the
+// head of the list, and keeps the order of the rest.
+func preferOwnedBy(list []*Lease, workerId string) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].wasOwnedBy(workerId) && !list[j].wasOwnedBy(workerId)
+	})
+}
+
+// RendezvousStrategy assigns each lease a deterministic preferred owner using
+// rendezvous(highest random weight) hashing over the live workers that are
+// eligible to take it. A worker
+// takes the expired leases it prefers, and steals the leases it prefers from
+// other workers. When a worker joins or leaves the fleet, only the leases it
+// prefers(~1/N of the leases) move. If StealHysteresis is set, a preferred lease
+// is stolen only if its owner holds more than StealHysteresis leases above ours.
+//
+// Note that an expired lease is taken only by its preferred owner, so the
+// fleet membership must be accurate(see Config.WorkerTable). A lease that was
+// released after its max hold duration is taken by the preferred owner among the
+// workers other than the one that released it.
+type RendezvousStrategy struct{}
+
+// Choose implements the Strategy interface.
+func (s *RendezvousStrategy) Choose(v *View) (take, steal []*Lease) {
+	expired := make(map[string]bool, len(v.Expired))
+	for _, lease := range v.Expired {
+		expired[lease.Key] = true
+	}
+	// leaseCounts after the steals we chose so far
+	leaseCounts := make(map[string]int, len(v.LeaseCounts))
+	for worker, count := range v.LeaseCounts {
+		leaseCounts[worker] = count
+	}
+
+	for _, lease := range sortedLeases(v.Leases) {
+		if preferredOwner(lease.Key, v.Eligible(lease)) != v.WorkerId {
+			continue
+		}
+		if expired[lease.Key] {
+			take = append(take, lease)
+		} else if lease.Owner != v.WorkerId && len(steal) < v.MaxLeasesToSteal && v.CanSteal(lease) {
+			if v.StealHysteresis > 0 && leaseCounts[lease.Owner]-leaseCounts[v.WorkerId] <= v.StealHysteresis {
+				continue
+			}
+			steal = append(steal, lease)
+			leaseCounts[lease.Owner]--
+			leaseCounts[v.WorkerId]++
+		}
+	}
+
+	sortByPriority(take, true)
+	if n := len(take) + len(steal); n > 0 {
+		v.Logger.Debugf("Worker %s saw %d total leases, %d available leases, %d workers.\n"+
+			"I will take %d expired leases and steal %d preferred leases",
+			v.WorkerId,
+			len(v.Leases),
+			len(v.Expired),
+			len(v.Workers),
+			len(take),
+			len(steal))
+	}
+
+	return take, steal
+}
+
+// preferredOwner returns the worker with the highest weight for the given lease key.
+func preferredOwner(key string, workers []string) (owner string) {
+	var max uint64
+	for _, worker := range workers {
+		if w := weight(key, worker); owner == "" || w > max || w == max && worker < owner {
+			owner, max = worker, w
+		}
+	}
+	return
+}
+
+// weight returns the rendezvous weight of the given lease key and worker.
+func weight(key, worker string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(worker))
+	// fnv is weak at the high bits for short inputs. mix it(splitmix64 finalizer).
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// sortedLeases returns the leases sorted by their keys.
+func sortedLeases(m map[string]*Lease) []*Lease {
+	list := make([]*Lease, 0, len(m))
+	for _, lease := range m {
+		list = append(list, lease)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
@@ -0,0 +1,375 @@
+package lease
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func newTestView(workerId string, leases []*Lease, counts map[string]int) *View {
+	logger := logrus.New()
+	logger.Level = logrus.PanicLevel
+	v := &View{
+		WorkerId:         workerId,
+		Leases:           make(map[string]*Lease),
+		Workers:          make(map[string]Worker),
+		LeaseCounts:      counts,
+		MaxLeasesToSteal: 1,
+		Logger:           logger,
+	}
+	for id := range counts {
+		v.Workers[id] = Worker{Id: id}
+	}
+	for _, lease := range leases {
+		v.Leases[lease.Key] = lease
+		if lease.hasNoOwner() {
+			v.Expired = append(v.Expired, lease)
+		}
+	}
+	return v
+}
+
+func TestRendezvousChurn(t *testing.T) {
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("shard-%d", i))
+	}
+	workers := []string{"w1", "w2", "w3", "w4"}
+	before := make(map[string]string)
+	for _, k := range keys {
+		before[k] = preferredOwner(k, workers)
+	}
+
+	// deterministic regardless of the workers order
+	reversed := []string{"w4", "w3", "w2", "w1"}
+	for _, k := range keys {
+		assert(t, preferredOwner(k, reversed) == before[k], "expect the preferred owner to be deterministic")
+	}
+
+	// a worker joins. only leases that move are the ones the new worker prefers.
+	moved := 0
+	for _, k := range keys {
+		owner := preferredOwner(k, append(workers, "w5"))
+		if owner != before[k] {
+			assert(t, owner == "w5", fmt.Sprintf("expect %s to move only to the new worker", k))
+			moved++
+		}
+	}
+	assert(t, moved > 100 && moved < 300, fmt.Sprintf("expect ~1/5 of the leases to move, got %d", moved))
+
+	// a worker leaves. only its leases move.
+	for _, k := range keys {
+		if owner := preferredOwner(k, workers[1:]); owner != before[k] {
+			assert(t, before[k] == "w1", fmt.Sprintf("expect %s to move only from the leaving worker", k))
+		}
+	}
+}
+
+func TestRendezvousStrategy(t *testing.T) {
+	counts := map[string]int{"1": 0, "2": 0}
+	var leases []*Lease
+	for i := 0; i < 20; i++ {
+		leases = append(leases, &Lease{Key: fmt.Sprintf("shard-%d", i), Owner: "NULL"})
+	}
+
+	// all leases are available. each worker takes only the leases it prefers.
+	s := &RendezvousStrategy{}
+	take1, steal1 := s.Choose(newTestView("1", leases, counts))
+	take2, steal2 := s.Choose(newTestView("2", leases, counts))
+	assert(t, len(steal1) == 0 && len(steal2) == 0, "expect not to steal available leases")
+	assert(t, len(take1)+len(take2) == len(leases), "expect all leases to be taken")
+	taken := make(map[string]string)
+	for _, lease := range take1 {
+		taken[lease.Key] = "1"
+	}
+	for _, lease := range take2 {
+		_, ok := taken[lease.Key]
+		assert(t, !ok, fmt.Sprintf("expect %s to be taken by one worker", lease.Key))
+		taken[lease.Key] = "2"
+	}
+
+	// worker "2" holds all leases. worker "1" steals its preferred leases,
+	// up to MaxLeasesToSteal.
+	for _, lease := range leases {
+		lease.Owner = "2"
+	}
+	v := newTestView("1", leases, map[string]int{"1": 0, "2": len(leases)})
+	v.MaxLeasesToSteal = 2
+	take1, steal1 = s.Choose(v)
+	assert(t, len(take1) == 0, "expect not to take unavailable leases")
+	assert(t, len(steal1) == 2, "expect to steal MaxLeasesToSteal leases")
+	for _, lease := range steal1 {
+		assert(t, taken[lease.Key] == "1", fmt.Sprintf("expect to steal only preferred leases, got %s", lease.Key))
+	}
+
+	// worker "2" stopped sending heartbeats. worker "1" prefers all of its leases.
+	for _, lease := range leases {
+		lease.Owner = "2"
+		lease.lastRenewal = time.Now().Add(-time.Hour)
+	}
+	v = newTestView("1", leases, map[string]int{"1": 0, "2": len(leases)})
+	delete(v.Workers, "2")
+	v.Expired = leases
+	take1, _ = s.Choose(v)
+	assert(t, len(take1) == len(leases), "expect to take the leases of the dead worker")
+
+	// StealHysteresis
+	for _, lease := range leases {
+		lease.Owner = "2"
+	}
+	v = newTestView("1", leases, map[string]int{"1": 9, "2": 11})
+	v.MaxLeasesToSteal = 2
+	v.StealHysteresis = 2
+	_, steal1 = s.Choose(v)
+	assert(t, len(steal1) == 0, "expect not to steal within the hysteresis")
+	v.LeaseCounts = map[string]int{"1": 8, "2": 12}
+	_, steal1 = s.Choose(v)
+	assert(t, len(steal1) == 1, "expect to steal until the difference is within the hysteresis")
+}
+
+func TestBalancedStrategyAffinity(t *testing.T) {
+	leases := []*Lease{
+		{Key: "foo", Owner: "NULL", PreviousOwner: "2"},
+		{Key: "bar", Owner: "NULL", PreviousOwner: "1"},
+		{Key: "baz", Owner: "NULL"},
+		{Key: "qux", Owner: "NULL", PreviousOwner: "1"},
+	}
+	s := &BalancedStrategy{}
+	for i := 0; i < 10; i++ {
+		take, steal := s.Choose(newTestView("1", leases, map[string]int{"1": 0, "2": 0}))
+		assert(t, len(steal) == 0 && len(take) == 2, "expect to take 2 leases")
+		for _, lease := range take {
+			assert(t, lease.PreviousOwner == "1", fmt.Sprintf("expect to prefer previously owned leases, got %s", lease.Key))
+		}
+	}
+
+	// stealing
+	leases = []*Lease{
+		{Key: "foo", Owner: "2"},
+		{Key: "bar", Owner: "2", PreviousOwner: "1"},
+		{Key: "baz", Owner: "2"},
+		{Key: "qux", Owner: "2"},
+	}
+	for i := 0; i < 10; i++ {
+		take, steal := s.Choose(newTestView("1", leases, map[string]int{"1": 0, "2": 4}))
+		assert(t, len(take) == 0 && len(steal) == 1, "expect to steal 1 lease")
+		assert(t, steal[0].Key == "bar", fmt.Sprintf("expect to prefer previously owned leases, got %s", steal[0].Key))
+	}
+}
+
+func TestBalancedStrategyZones(t *testing.T) {
+	var leases []*Lease
+	owners := map[string]int{"a1": 4, "a2": 4, "b1": 5, "b2": 1}
+	for owner, n := range owners {
+		for i := 0; i < n; i++ {
+			leases = append(leases, &Lease{Key: fmt.Sprintf("%s-%d", owner, i), Owner: owner})
+		}
+	}
+	counts := map[string]int{"me": 0}
+	for owner, n := range owners {
+		counts[owner] = n
+	}
+	v := newTestView("me", leases, counts)
+	v.Workers = map[string]Worker{
+		"a1": {Id: "a1", Zone: "a"},
+		"a2": {Id: "a2", Zone: "a"},
+		"b1": {Id: "b1", Zone: "b"},
+		"b2": {Id: "b2", Zone: "b"},
+		"me": {Id: "me", Zone: "c"},
+	}
+	assert(t, v.mostOverloadedZone(v.LeaseCounts) == "a", "expect zone 'a' to be the most over-represented")
+
+	// b1 is the most loaded worker, but zone 'a' holds more than its share.
+	s := &BalancedStrategy{}
+	for i := 0; i < 10; i++ {
+		take, steal := s.Choose(v)
+		assert(t, len(take) == 0 && len(steal) == 1, "expect to steal 1 lease")
+		assert(t, v.Workers[steal[0].Owner].Zone == "a", fmt.Sprintf("expect to steal from zone 'a', got %s", steal[0].Owner))
+	}
+
+	// without zones, steal from the most loaded worker.
+	v.Workers = nil
+	assert(t, v.mostOverloadedZone(v.LeaseCounts) == "", "expect no zone")
+	_, steal := s.Choose(v)
+	assert(t, len(steal) == 1 && steal[0].Owner == "b1", "expect to steal from the most loaded worker")
+}
+
+// simulate runs taking cycles of the given strategy over a fleet with the given
+// lease owners and new(idle) workers. in each cycle, every worker runs the strategy
+// on the current state and takes the leases it chose. returns the number of cycles
+// until a cycle ends without ownership changes, and the final lease counts.
+func simulate(s Strategy, owners map[string]int, newWorkers, maxSteal, maxCycles int) (int, map[string]int) {
+	var (
+		leases  []*Lease
+		workers []string
+	)
+	for owner, n := range owners {
+		workers = append(workers, owner)
+		for i := 0; i < n; i++ {
+			leases = append(leases, &Lease{Key: fmt.Sprintf("%s-%d", owner, i), Owner: owner})
+		}
+	}
+	for i := 0; i < newWorkers; i++ {
+		workers = append(workers, fmt.Sprintf("new-%d", i))
+	}
+	counts := func() map[string]int {
+		m := make(map[string]int)
+		for _, worker := range workers {
+			m[worker] = 0
+		}
+		for _, lease := range leases {
+			m[lease.Owner]++
+		}
+		return m
+	}
+	for cycle := 1; cycle <= maxCycles; cycle++ {
+		changed := false
+		for _, worker := range workers {
+			v := newTestView(worker, leases, counts())
+			v.MaxLeasesToSteal = maxSteal
+			take, steal := s.Choose(v)
+			for _, lease := range append(take, steal...) {
+				lease.Owner = worker
+				changed = true
+			}
+		}
+		if !changed {
+			return cycle, counts()
+		}
+	}
+	return maxCycles, counts()
+}
+
+func TestBalancedStrategyConvergence(t *testing.T) {
+	tests := []struct {
+		name       string
+		owners     map[string]int
+		newWorkers int
+		maxSteal   int
+		maxCycles  int
+	}{
+		{"1 loaded worker, 1 new worker", map[string]int{"a": 10}, 1, 1, 6},
+		{"1 loaded worker, 9 new workers", map[string]int{"a": 100}, 9, 1, 12},
+		{"1 loaded worker, 9 new workers, steal 5", map[string]int{"a": 100}, 9, 5, 4},
+		{"3 loaded workers, 1 new worker, steal 8", map[string]int{"a": 10, "b": 10, "c": 10}, 1, 8, 3},
+		{"4 loaded workers, 4 new workers, steal 3", map[string]int{"a": 25, "b": 25, "c": 25, "d": 25}, 4, 3, 7},
+		{"uneven workers, 2 new workers, steal 2", map[string]int{"a": 30, "b": 20, "c": 10, "d": 4}, 2, 2, 12},
+	}
+	for _, test := range tests {
+		cycles, counts := simulate(&BalancedStrategy{}, test.owners, test.newWorkers, test.maxSteal, 100)
+		t.Logf("%s: converged in %d cycles, lease counts: %v", test.name, cycles, counts)
+		if cycles > test.maxCycles {
+			t.Errorf("%s: expect to converge in %d cycles, got %d", test.name, test.maxCycles, cycles)
+		}
+		lo, hi := -1, 0
+		for _, n := range counts {
+			if lo == -1 || n < lo {
+				lo = n
+			}
+			if n > hi {
+				hi = n
+			}
+		}
+		if hi-lo > 1 {
+			t.Errorf("%s: expect the leases to be balanced, got %v", test.name, counts)
+		}
+	}
+}
+
+func TestBalancedStrategyAntiThrash(t *testing.T) {
+	newLeases := func() []*Lease {
+		return []*Lease{
+			{Key: "foo", Owner: "1"},
+			{Key: "bar", Owner: "1"},
+			{Key: "baz", Owner: "1"},
+			{Key: "qux", Owner: "1"},
+			{Key: "quux", Owner: "2"},
+			{Key: "corge", Owner: "2"},
+		}
+	}
+	counts := map[string]int{"1": 4, "2": 2}
+	s := &BalancedStrategy{}
+
+	// worker "2" needs 1 lease. worker "1" has 4 and the target is 3.
+	_, steal := s.Choose(newTestView("2", newLeases(), counts))
+	assert(t, len(steal) == 1, "expect to steal 1 lease")
+
+	// hysteresis
+	v := newTestView("2", newLeases(), counts)
+	v.StealHysteresis = 2
+	_, steal = s.Choose(v)
+	assert(t, len(steal) == 0, "expect not to steal when the difference is in the hysteresis band")
+	v.StealHysteresis = 1
+	_, steal = s.Choose(v)
+	assert(t, len(steal) == 1, "expect to steal when the difference is above the hysteresis band")
+
+	// minimum hold time
+	leases := newLeases()
+	for _, lease := range leases {
+		lease.acquiredAt = time.Now()
+	}
+	leases[0].acquiredAt = time.Now().Add(-time.Hour)
+	v = newTestView("2", leases, counts)
+	v.MinHoldDuration = time.Minute
+	for i := 0; i < 10; i++ {
+		_, steal = s.Choose(v)
+		assert(t, len(steal) == 1 && steal[0].Key == "foo", "expect to steal only leases that held for MinHoldDuration")
+	}
+	leases[0].acquiredAt = time.Now()
+	_, steal = s.Choose(v)
+	assert(t, len(steal) == 0, "expect not to steal leases that held less than MinHoldDuration")
+
+	// steal cool-down
+	leases = newLeases()
+	for _, lease := range leases {
+		lease.stolenAt = time.Now()
+	}
+	leases[1].stolenAt = time.Time{}
+	v = newTestView("2", leases, counts)
+	v.StealCooldown = time.Minute
+	for i := 0; i < 10; i++ {
+		_, steal = s.Choose(v)
+		assert(t, len(steal) == 1 && steal[0].Key == "bar", "expect to steal only leases that were not stolen recently")
+	}
+}
+
+func TestBalancedStrategyPriority(t *testing.T) {
+	leases := []*Lease{
+		{Key: "foo", Owner: "NULL", Priority: 1},
+		{Key: "bar", Owner: "NULL"},
+		{Key: "baz", Owner: "NULL", Priority: 10},
+		{Key: "qux", Owner: "NULL", Priority: -1},
+		{Key: "quux", Owner: "NULL", Priority: 10},
+		{Key: "corge", Owner: "NULL"},
+	}
+	s := &BalancedStrategy{}
+	for i := 0; i < 10; i++ {
+		take, _ := s.Choose(newTestView("1", leases, map[string]int{"1": 0, "2": 0}))
+		assert(t, len(take) == 3, "expect to take 3 leases")
+		assert(t, take[0].Priority == 10 && take[1].Priority == 10 && take[2].Priority == 1,
+			"expect to take higher priority leases first")
+	}
+
+	// stealing
+	leases = []*Lease{
+		{Key: "foo", Owner: "2", Priority: 10},
+		{Key: "bar", Owner: "2", Priority: 10},
+		{Key: "baz", Owner: "2"},
+		{Key: "qux", Owner: "2", Priority: -1},
+	}
+	v := newTestView("1", leases, map[string]int{"1": 0, "2": 4})
+	v.MaxLeasesToSteal = 2
+	_, steal := s.Choose(v)
+	assert(t, len(steal) == 2, "expect to steal 2 leases")
+	assert(t, steal[0].Key == "qux" && steal[1].Key == "baz", "expect to steal lower priority leases first")
+
+	v.MaxLeasesToSteal = 4
+	_, steal = s.Choose(v)
+	assert(t, len(steal) == 2, "expect never to steal high priority leases")
+
+	v.MaxStealPriority = 10
+	_, steal = s.Choose(v)
+	assert(t, len(steal) == 2 && steal[0].Key == "qux", "expect to steal up to the target")
+}
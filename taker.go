@@ -1,6 +1,10 @@
 package lease
 
-import "math/rand"
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
 
 // Taker is the interface that wraps the Take method.
 // It  used by Coordinator to take new leases, or leases that other workers fail to renew.
@@ -17,13 +21,19 @@ type leaseTaker struct {
 
 	// leaseTaker state
 	allLeases map[string]*Lease
+	// handoffs holds the time we asked for each lease that is pending to be
+	// handed off to us.
+	handoffs map[string]time.Time
 }
 
 // Compute the set of leases available to be taken and attempt to take them. Lease taking process is:
 //
-// 1) If a lease's counter hasn't changed in long enough(i.e: "expired") set its owner to null.
-// 2) Compute the "leases per worker" and the number we should take.
-// 3) If we need to take leases, try to take expired leases. if there are no expired leases, consider stealing.
+// 1) If a lease's counter hasn't changed in long enough(i.e: "expired") set its owner to null,
+// and delete the leases that were completed for longer than the retention period.
+// 2) Compute the "leases per worker"(over all live eligible workers) and the expired leases.
+// 3) Ask the Strategy which leases to take or steal, limit the steals by the steal budget, and try to take them.
+// In handoff mode, ask the owners to hand off the leases to steal, and take them only if they were
+// not handed off within the handoff timeout.
 func (l *leaseTaker) Take() error {
 	list, err := l.manager.ListLeases()
 	if err != nil {
@@ -32,160 +42,299 @@ func (l *leaseTaker) Take() error {
 
 	l.updateLeases(list)
 
-	leaseCounts := l.computeLeaseCounts()
-	numWorkers := len(leaseCounts)
-	// assuming numLeases <= numWorkers
-	target := 1
-	// our target for each worker is numLeases / numWorkers (+1 if numWorkers doesn't evenly divide numLeases)
-	if len(l.allLeases) > numWorkers {
-		target = len(l.allLeases) / numWorkers
-		if len(list)%numWorkers != 0 {
-			target++
-		}
+	// the heartbeats are used to learn about idle and dead workers. if we fail
+	// to get them, fall back to the workers that hold leases.
+	workers, err := l.manager.ListWorkers()
+	if err != nil {
+		l.Logger.WithError(err).Warnf("Worker %s failed to list workers", l.WorkerId)
+		workers = l.leaseOwners()
 	}
 
-	myCount := leaseCounts[l.WorkerId]
-	numToReachTarget := target - myCount
+	l.removeCompletedLeases()
+	l.removeExpiredWorkers(workers)
+	l.takeTimedOutHandoffs()
 
-	if numToReachTarget <= 0 {
-		l.Logger.Debugf("Worker %s does not need to take leases. we have %d, and the target is: %d",
-			l.WorkerId,
-			myCount,
-			target)
-		return nil
-	}
+	leasesToTake, leasesToSteal := l.Strategy.Choose(l.view(workers))
 
-	var leasesToTake []*Lease
-	expiredLeases := l.getExpiredLeases()
-
-	if len(expiredLeases) > 0 {
-		// shuffle expiredLeases so workers don't all try to contend for the same leases.
-		shuffle(expiredLeases)
-		if numExpired := len(expiredLeases); numToReachTarget > numExpired {
-			numToReachTarget = numExpired
+	// check the cluster-wide steal budget before stealing.
+	if l.StealBudget > 0 && len(leasesToSteal) > 0 {
+		n, err := l.manager.AcquireStealBudget(len(leasesToSteal))
+		if err != nil {
+			l.Logger.WithError(err).Warnf("Worker %s failed to acquire steal budget", l.WorkerId)
 		}
-		leasesToTake = expiredLeases[:numToReachTarget]
-	} else {
-		l.Logger.Debugf("Worker %s needed %d leases but none were expired. consider stealing",
-			l.WorkerId,
-			numToReachTarget)
-		leasesToTake = l.chooseLeasesToSteal(leaseCounts, numToReachTarget, target)
+		if n < len(leasesToSteal) {
+			l.Logger.Debugf("Worker %s planned to steal %d leases, but the steal budget allows only %d",
+				l.WorkerId,
+				len(leasesToSteal),
+				n)
+		}
+		leasesToSteal = leasesToSteal[:n]
 	}
 
 	for _, lease := range leasesToTake {
-		if err := l.manager.TakeLease(lease); err != nil {
-			l.Logger.WithError(err).Debugf("Worker %s could not take lease with key %s.",
-				l.WorkerId,
-				lease.Key)
+		l.takeLease(lease, false)
+	}
+	failed := 0
+	for _, lease := range leasesToSteal {
+		ok := false
+		if l.HandoffTimeout > 0 {
+			ok = l.requestHandoff(lease)
 		} else {
-			l.Logger.Debugf("Worker %s took lease: %s successfully.", l.WorkerId, lease.Key)
+			ok = l.takeLease(lease, true)
+		}
+		if !ok {
+			failed++
 		}
 	}
 
-	if len(leasesToTake) > 0 {
-		l.Logger.Debugf("Worker %s saw %d total leases, %d available leases, %d workers.\n"+
-			"Target is %d leases, I have %d leases, I plan to take %d leases, I will take %d leases",
-			l.WorkerId,
-			len(l.allLeases),
-			len(expiredLeases),
-			numWorkers,
-			target,
-			myCount,
-			numToReachTarget,
-			len(leasesToTake))
+	// return the budget of the failed steals, so the fleet can use it.
+	if l.StealBudget > 0 && failed > 0 {
+		if err := l.manager.ReleaseStealBudget(failed); err != nil {
+			l.Logger.WithError(err).Warnf("Worker %s failed to release steal budget", l.WorkerId)
+		}
 	}
 
 	return nil
 }
 
-// Choose leases to steal by randomly selecting one or more (up to max) from the most loaded worker.
-//
-// Steal up to maxLeasesToStealAtOneTime leases from the most loaded worker if
-// 1. he has > target leases and I need >= 1 leases : steal min(leases needed, maxLeasesToStealAtOneTime)
-// 2. he has == target leases and I need > 1 leases : steal 1
-func (l *leaseTaker) chooseLeasesToSteal(leaseCounts map[string]int, needed, target int) []*Lease {
-	var mostLoadedWorker string
-	// find the most loaded worker
-	for worker, count := range leaseCounts {
-		if mostLoadedWorker == "" || leaseCounts[mostLoadedWorker] < count {
-			mostLoadedWorker = worker
-		}
+// Take the given lease, and track the ownership change. returns false if
+// the lease was not taken.
+func (l *leaseTaker) takeLease(lease *Lease, steal bool) bool {
+	if err := l.manager.TakeLease(lease); err != nil {
+		l.Logger.WithError(err).Debugf("Worker %s could not take lease with key %s.",
+			l.WorkerId,
+			lease.Key)
+		return false
 	}
-
-	numLeasesToSteal := 0
-	if count := leaseCounts[mostLoadedWorker]; count >= target {
-		overTarget := count - target
-		numLeasesToSteal = min(needed, overTarget)
-		// steal 1 if we need > 1 and max loaded worker has target leases.
-		if needed > 1 && numLeasesToSteal == 0 {
-			numLeasesToSteal = 1
-		}
-		numLeasesToSteal = min(numLeasesToSteal, l.MaxLeasesToStealAtOneTime)
+	lease.acquiredAt = time.Now()
+	lease.lastRenewal = lease.acquiredAt
+	if steal {
+		lease.stolenAt = lease.acquiredAt
 	}
+	l.Logger.Debugf("Worker %s took lease: %s successfully.", l.WorkerId, lease.Key)
+	return true
+}
 
-	if numLeasesToSteal <= 0 {
-		l.Logger.Debugf("Worker %s not stealing from most loaded worker %s.\n"+
-			"He has %d, target is %d, and I need %d.",
+// Ask the owner of the given lease to hand it off to us. returns false if
+// the request failed.
+func (l *leaseTaker) requestHandoff(lease *Lease) bool {
+	if err := l.manager.RequestHandoff(lease); err != nil {
+		l.Logger.WithError(err).Debugf("Worker %s could not request handoff of lease with key %s.",
 			l.WorkerId,
-			mostLoadedWorker,
-			leaseCounts[mostLoadedWorker],
-			target,
-			needed)
-		return nil
-	}
-
-	l.Logger.Debugf("Worker %s will attempt to steal %d leases from most loaded worker %s.\n"+
-		"He has %d leases, target is %d, and I need %d.",
-		l.WorkerId,
-		numLeasesToSteal,
-		mostLoadedWorker,
-		leaseCounts[mostLoadedWorker],
-		target,
-		needed)
-
-	var candidates []*Lease
-	for _, lease := range l.allLeases {
-		if lease.Owner == mostLoadedWorker {
-			candidates = append(candidates, lease)
-		}
+			lease.Key)
+		return false
+	}
+	if l.handoffs == nil {
+		l.handoffs = make(map[string]time.Time)
 	}
-	shuffle(candidates)
+	l.handoffs[lease.Key] = time.Now()
+	l.Logger.Debugf("Worker %s requested handoff of lease: %s from worker %s.", l.WorkerId, lease.Key, lease.Owner)
+	return true
+}
 
-	return candidates[:numLeasesToSteal]
+// Take forcefully the leases that were not handed off to us within HandoffTimeout,
+// and forget the handoff requests that are not pending anymore.
+func (l *leaseTaker) takeTimedOutHandoffs() {
+	for key, requestedAt := range l.handoffs {
+		lease, ok := l.allLeases[key]
+		if !ok || lease.PendingOwner != l.WorkerId {
+			delete(l.handoffs, key)
+			continue
+		}
+		if time.Since(requestedAt) > l.HandoffTimeout {
+			delete(l.handoffs, key)
+			l.Logger.Debugf("Worker %s did not get lease %s within the handoff timeout. taking it forcefully.",
+				l.WorkerId,
+				key)
+			// the steal budget was reserved when we requested the handoff.
+			if !l.takeLease(lease, true) && l.StealBudget > 0 {
+				if err := l.manager.ReleaseStealBudget(1); err != nil {
+					l.Logger.WithError(err).Warnf("Worker %s failed to release steal budget", l.WorkerId)
+				}
+			}
+		}
+	}
 }
 
 // Scan all leases and update lastRenewalTime. Add new leases and delete old leases.
 func (l *leaseTaker) updateLeases(list []*Lease) {
 	allLeases := make(map[string]*Lease)
 	for _, newLease := range list {
+		scannedAt := newLease.lastRenewal
 		// if we've seen this lease before.
 		if oldLease, ok := l.allLeases[newLease.Key]; ok {
 			// and the counter has changed, set lastRenewal to the time of the scan.
 			if oldLease.Counter != newLease.Counter {
+				newLease.lastRenewal = l.renewalTime(newLease)
+				newLease.acquiredAt, newLease.stolenAt = oldLease.acquiredAt, oldLease.stolenAt
+				// and the owner has changed, track the ownership change.
+				if oldLease.Owner != newLease.Owner {
+					newLease.acquiredAt = newLease.lastRenewal
+					if !oldLease.hasNoOwner() && !newLease.hasNoOwner() {
+						newLease.stolenAt = newLease.lastRenewal
+					}
+				}
 				allLeases[oldLease.Key] = newLease
 			} else {
-				if oldLease.isExpired(l.ExpireAfter) {
+				// keep the local tracking of the lease, but take the rest of the
+				// fields(e.g: completion marker) from the scan.
+				newLease.lastRenewal = oldLease.lastRenewal
+				newLease.acquiredAt, newLease.stolenAt = oldLease.acquiredAt, oldLease.stolenAt
+				// evictions and releases set the owner to NULL without changing the counter.
+				if oldLease.Owner != newLease.Owner {
+					newLease.acquiredAt = scannedAt
+				}
+				// leases without owner(e.g: scheduled leases) have nothing to evict.
+				if newLease.isExpired(l.ExpireAfter) && !newLease.Completed && !newLease.hasNoOwner() {
 					// in some cases that "other" worker evict this lease
 					// and set his owner to NULL
-					oldLease.Owner = newLease.Owner
-					if err := l.manager.EvictLease(oldLease); err != nil {
+					if err := l.manager.EvictLease(newLease); err != nil {
 						l.Logger.WithError(err).Warnf("Worker %s failed to evict lease with key %s",
 							l.WorkerId,
 							newLease.Key)
 					}
 				}
-				allLeases[oldLease.Key] = oldLease
+				allLeases[newLease.Key] = newLease
 			}
 		} else {
+			// we don't know when the current owner acquired this lease.
+			newLease.acquiredAt = newLease.lastRenewal
+			newLease.lastRenewal = l.renewalTime(newLease)
 			allLeases[newLease.Key] = newLease
 		}
 	}
 	l.allLeases = allLeases
 }
 
-// Get list of leases that were expired as of our last scan.
-func (l *leaseTaker) getExpiredLeases() (list []*Lease) {
+// renewalTime returns the time of the last renewal of the given scanned lease. In
+// wall-clock expiry mode it's the written renewal time plus MaxClockSkew(if it's
+// earlier than the scan), so the expiry is not delayed by our own observation.
+func (l *leaseTaker) renewalTime(lease *Lease) time.Time {
+	if !l.WallClockExpiry || lease.RenewedAt.IsZero() {
+		return lease.lastRenewal
+	}
+	if t := lease.RenewedAt.Add(l.MaxClockSkew); t.Before(lease.lastRenewal) {
+		return t
+	}
+	return lease.lastRenewal
+}
+
+// leaseOwners returns the owners of the leases as live workers(without labels). it's
+// used when the heartbeats are not available.
+func (l *leaseTaker) leaseOwners() (workers []Worker) {
+	seen := make(map[string]bool)
 	for _, lease := range l.allLeases {
+		if lease.hasNoOwner() || seen[lease.Owner] {
+			continue
+		}
+		seen[lease.Owner] = true
+		workers = append(workers, Worker{Id: lease.Owner, LastSeen: time.Now()})
+	}
+	return
+}
+
+// Build the cluster view for the Strategy. The view contains only the uncompleted leases
+// whose requirements match our labels, whose parents are completed, whose not-before
+// time has passed and that we did not just release, and the live workers that are eligible
+// to take at least one of them. So the "leases per worker" is computed over the
+// eligible workers only.
+func (l *leaseTaker) view(workers []Worker) *View {
+	v := &View{
+		WorkerId:         l.WorkerId,
+		Leases:           make(map[string]*Lease),
+		Workers:          make(map[string]Worker),
+		MaxLeasesToSteal: l.MaxLeasesToStealAtOneTime,
+		MinHoldDuration:  l.MinHoldDuration,
+		StealCooldown:    l.StealCooldown,
+		StealHysteresis:  l.StealHysteresis,
+		MaxStealPriority: l.MaxStealPriority,
+		Released:         make(map[string]string),
+		Logger:           l.Logger,
+	}
+	var blocked, scheduled, released []string
+	for key, lease := range l.allLeases {
+		if lease.Completed || !lease.matches(l.Labels) {
+			continue
+		}
+		if !l.parentsCompleted(lease) {
+			blocked = append(blocked, key)
+			continue
+		}
+		if lease.isScheduled() {
+			scheduled = append(scheduled, key)
+			continue
+		}
+		if releaser := l.releasedBy(lease); releaser != "" {
+			if releaser == l.WorkerId {
+				released = append(released, key)
+				continue
+			}
+			v.Released[key] = releaser
+		}
+		v.Leases[key] = lease
+	}
+	if n := len(blocked); n > 0 {
+		l.Logger.Debugf("Worker %s ignores %d leases with uncompleted parents: %s",
+			l.WorkerId,
+			n,
+			strings.Join(blocked, ", "))
+	}
+	if n := len(scheduled); n > 0 {
+		l.Logger.Debugf("Worker %s ignores %d leases scheduled to a future time: %s",
+			l.WorkerId,
+			n,
+			strings.Join(scheduled, ", "))
+	}
+	if n := len(released); n > 0 {
+		l.Logger.Debugf("Worker %s ignores %d leases it released after their max hold duration: %s",
+			l.WorkerId,
+			n,
+			strings.Join(released, ", "))
+	}
+	v.Workers[l.WorkerId] = Worker{Id: l.WorkerId, Labels: l.Labels, Zone: l.Zone}
+	for _, worker := range workers {
+		if worker.Id == l.WorkerId || worker.isExpired(l.ExpireAfter) {
+			continue
+		}
+		for _, lease := range v.Leases {
+			if lease.matches(worker.Labels) {
+				v.Workers[worker.Id] = worker
+				break
+			}
+		}
+	}
+	v.LeaseCounts = l.computeLeaseCounts(v.Workers, v.Leases)
+	v.Expired = l.getExpiredLeases(v.Leases)
+	return v
+}
+
+// parentsCompleted returns true if all the parents of the given lease are completed,
+// or do not exist anymore.
+func (l *leaseTaker) parentsCompleted(lease *Lease) bool {
+	for _, key := range lease.Parents {
+		if parent, ok := l.allLeases[key]; ok && !parent.Completed {
+			return false
+		}
+	}
+	return true
+}
+
+// releasedBy returns the worker that released the given lease after its max hold
+// duration, if it was released in the last ExpireAfter(as observed by the Taker).
+// it lets the other workers take the lease, instead of the worker that released it.
+func (l *leaseTaker) releasedBy(lease *Lease) string {
+	if lease.hasNoOwner() &&
+		lease.PreviousOwner != "" &&
+		lease.maxHoldDuration(l.MaxHoldDuration) > 0 &&
+		time.Since(lease.acquiredAt) < l.ExpireAfter {
+		return lease.PreviousOwner
+	}
+	return ""
+}
+
+// Get list of leases that were expired as of our last scan.
+func (l *leaseTaker) getExpiredLeases(leases map[string]*Lease) (list []*Lease) {
+	for _, lease := range leases {
 		if lease.isExpired(l.ExpireAfter) || lease.hasNoOwner() {
 			list = append(list, lease)
 		}
@@ -193,17 +342,76 @@ func (l *leaseTaker) getExpiredLeases() (list []*Lease) {
 	return
 }
 
+// Delete the leases that were completed for longer than CompletedRetention.
+// the children of a deleted lease regard it as completed.
+func (l *leaseTaker) removeCompletedLeases() {
+	if l.CompletedRetention == 0 {
+		return
+	}
+	for key, lease := range l.allLeases {
+		if !lease.Completed || lease.CompletedAt.IsZero() || time.Since(lease.CompletedAt) <= l.CompletedRetention {
+			continue
+		}
+		if err := l.manager.DeleteLease(lease); err != nil {
+			l.Logger.WithError(err).Warnf("Worker %s failed to delete completed lease with key %s",
+				l.WorkerId,
+				key)
+		} else {
+			delete(l.allLeases, key)
+			l.Logger.Debugf("Worker %s deleted lease with key %s, completed at %s",
+				l.WorkerId,
+				key,
+				lease.CompletedAt)
+		}
+	}
+}
+
+// Delete the heartbeat records of workers that did not send a heartbeat for
+// longer than ExpireAfter. the records are deleted only if they did not change
+// since the scan, and a live worker will re-create its record on its next heartbeat.
+func (l *leaseTaker) removeExpiredWorkers(workers []Worker) {
+	for _, worker := range workers {
+		if worker.Id == l.WorkerId || !worker.isExpired(l.ExpireAfter) {
+			continue
+		}
+		worker := worker
+		if ok, err := l.manager.RemoveExpiredWorker(&worker); err != nil {
+			l.Logger.WithError(err).Warnf("Worker %s failed to remove expired worker %s",
+				l.WorkerId,
+				worker.Id)
+		} else if !ok {
+			l.Logger.Debugf("Worker %s did not remove worker %s, it sent a heartbeat since the scan",
+				l.WorkerId,
+				worker.Id)
+		} else {
+			l.Logger.Debugf("Worker %s removed expired worker %s, last seen at %s",
+				l.WorkerId,
+				worker.Id,
+				worker.LastSeen)
+		}
+	}
+}
+
 // Compute the number of leases I should try to take based on the state of the system.
-func (l *leaseTaker) computeLeaseCounts() map[string]int {
+// Live workers that don't hold any lease are counted with zero leases, and leases that
+// are being handed off are counted for their pending owner.
+func (l *leaseTaker) computeLeaseCounts(workers map[string]Worker, leases map[string]*Lease) map[string]int {
 	m := make(map[string]int)
-	for _, lease := range l.allLeases {
+	for id := range workers {
+		m[id] = 0
+	}
+	for _, lease := range leases {
 		if lease.hasNoOwner() {
 			continue
 		}
-		if _, ok := m[lease.Owner]; ok {
-			m[lease.Owner]++
+		owner := lease.Owner
+		if lease.PendingOwner != "" {
+			owner = lease.PendingOwner
+		}
+		if _, ok := m[owner]; ok {
+			m[owner]++
 		} else {
-			m[lease.Owner] = 1
+			m[owner] = 1
 		}
 	}
 
@@ -1,10 +1,10 @@
 package lease
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
-
-	"github.com/Sirupsen/logrus"
 )
 
 type takerTest struct {
@@ -93,22 +93,65 @@ var takerTestCases = []takerTest{
 			methodEvict: 3,
 		},
 	},
+	{
+		`3 live workers(including me), one of them is idle. 3 leases.
+		worker "1" holds all of them, and I does not hold any lease.
+		expect to steal 1 and to remove the expired worker "4"`,
+		make(map[string]*Lease),
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: "foo", Owner: "1", lastRenewal: time.Now()},
+				&Lease{Key: "bar", Owner: "1", lastRenewal: time.Now()},
+				&Lease{Key: "baz", Owner: "1", lastRenewal: time.Now()},
+			}},
+			methodListWorkers: {[]Worker{
+				{Id: "1", LastSeen: time.Now()},
+				{Id: "2", LastSeen: time.Now()},
+				{Id: takerId, LastSeen: time.Now()},
+				{Id: "4", LastSeen: time.Now().Add(-time.Hour)},
+			}},
+			methodRemoveWorker: {nil},
+			methodTake:         {nil},
+		},
+		map[method]int{
+			methodList:         1,
+			methodListWorkers:  1,
+			methodRemoveWorker: 1,
+			methodTake:         1,
+		},
+	},
+	{
+		`4 live workers(including me), 2 of them are idle. 6 leases, and all of them expired.
+		expect the target to be 2 and not 3, and to take two leases.`,
+		make(map[string]*Lease),
+		map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: "foo", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+				&Lease{Key: "bar", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+				&Lease{Key: "baz", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+				&Lease{Key: "qux", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+				&Lease{Key: "quux", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+				&Lease{Key: "corge", Owner: "1", lastRenewal: time.Now().Add(-time.Hour)},
+			}},
+			methodListWorkers: {[]Worker{
+				{Id: "1", LastSeen: time.Now()},
+				{Id: "2", LastSeen: time.Now()},
+				{Id: "4", LastSeen: time.Now()},
+				{Id: takerId, LastSeen: time.Now()},
+			}},
+			methodTake: {nil, nil, nil},
+		},
+		map[method]int{
+			methodList:        1,
+			methodListWorkers: 1,
+			methodTake:        2,
+		},
+	},
 }
 
 func TestTakerCases(t *testing.T) {
 	for _, test := range takerTestCases {
-		logger := logrus.New()
-		logger.Level = logrus.PanicLevel
-		manager := newManagerMock(test.managerBehavior)
-		taker := &leaseTaker{
-			Config: &Config{WorkerId: takerId,
-				Logger:                    logger,
-				ExpireAfter:               time.Minute,
-				MaxLeasesToStealAtOneTime: 1,
-			},
-			manager:   manager,
-			allLeases: test.prevState,
-		}
+		taker, manager := newTestTaker(test.managerBehavior, &BalancedStrategy{}, test.prevState)
 		taker.Take()
 		// test method calls expectations
 		for method, calls := range test.expectedCalls {
@@ -118,3 +161,351 @@ func TestTakerCases(t *testing.T) {
 		}
 	}
 }
+
+// newTestTaker returns a taker with the test config, that uses a manager mock with
+// the given behavior, the given strategy and the given previous state(if it's set).
+// tests adjust the config before they call Take.
+func newTestTaker(behavior map[method]args, strategy Strategy, allLeases map[string]*Lease) (*leaseTaker, *managerMock) {
+	if allLeases == nil {
+		allLeases = make(map[string]*Lease)
+	}
+	manager := newManagerMock(behavior)
+	return &leaseTaker{
+		Config: &Config{
+			WorkerId:                  takerId,
+			Logger:                    newTestLogger(),
+			ExpireAfter:               time.Minute,
+			MaxLeasesToStealAtOneTime: 1,
+			Strategy:                  strategy,
+		},
+		manager:   manager,
+		allLeases: allLeases,
+	}, manager
+}
+
+// strategyMock records the view it gets and returns the stubbed leases.
+type strategyMock struct {
+	view        *View
+	take, steal []string
+}
+
+func (s *strategyMock) Choose(v *View) (take, steal []*Lease) {
+	s.view = v
+	for _, k := range s.take {
+		take = append(take, v.Leases[k])
+	}
+	for _, k := range s.steal {
+		steal = append(steal, v.Leases[k])
+	}
+	return
+}
+
+func TestTakerStrategy(t *testing.T) {
+	strategy := &strategyMock{take: []string{"bar"}, steal: []string{"foo"}}
+	taker, manager := newTestTaker(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "foo", Owner: "1", lastRenewal: time.Now()},
+			&Lease{Key: "bar", Owner: "NULL", lastRenewal: time.Now()},
+			&Lease{Key: "baz", Owner: takerId, lastRenewal: time.Now()},
+		}},
+		methodListWorkers: {[]Worker{
+			{Id: "2", LastSeen: time.Now()},
+		}},
+		methodTake: {nil, nil},
+	}, strategy, nil)
+	taker.MaxLeasesToStealAtOneTime = 3
+	taker.Take()
+
+	v := strategy.view
+	assert(t, v != nil, "expect the strategy to be called")
+	assert(t, v.WorkerId == takerId && v.MaxLeasesToSteal == 3, "expect the view to hold the taker config")
+	assert(t, len(v.Leases) == 3, "expect the view to hold all leases")
+	assert(t, len(v.LeaseCounts) == 3 && v.LeaseCounts["2"] == 0 && v.LeaseCounts[takerId] == 1,
+		"expect the lease counts to include the idle worker")
+	assert(t, len(v.Expired) == 1 && v.Expired[0].Key == "bar", "expect the ownerless lease to be available")
+	assert(t, manager.calls[methodTake] == 2, "expect to take the chosen leases")
+}
+
+func TestTakerLabels(t *testing.T) {
+	gpu := map[string]string{"gpu": "true"}
+	strategy := &strategyMock{}
+	taker, _ := newTestTaker(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "foo", Owner: "NULL", Requirements: gpu},
+			&Lease{Key: "bar", Owner: "NULL", Requirements: gpu},
+			&Lease{Key: "baz", Owner: "NULL"},
+			&Lease{Key: "qux", Owner: "NULL", Requirements: map[string]string{"tenant": "a"}},
+		}},
+		methodListWorkers: {[]Worker{
+			{Id: "1", LastSeen: time.Now(), Labels: gpu},
+			{Id: "2", LastSeen: time.Now(), Labels: map[string]string{"tenant": "a"}},
+		}},
+	}, strategy, nil)
+	taker.Labels = map[string]string{"gpu": "true", "zone": "b"}
+	taker.Take()
+
+	v := strategy.view
+	assert(t, len(v.Leases) == 3 && v.Leases["qux"] == nil, "expect the view to hold only the matching leases")
+	assert(t, len(v.Expired) == 3, "expect only the matching leases to be available")
+	// worker "2" is eligible only for "baz"
+	assert(t, len(v.LeaseCounts) == 3, "expect the lease counts to include the eligible workers")
+	assert(t, len(v.Eligible(v.Leases["foo"])) == 2, "expect 2 workers to be eligible for gpu lease")
+	assert(t, len(v.Eligible(v.Leases["baz"])) == 3, "expect all workers to be eligible for lease without requirements")
+
+	// worker "2" is not eligible for any of our leases
+	taker.manager = newManagerMock(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "foo", Owner: "NULL", Requirements: gpu},
+		}},
+		methodListWorkers: {[]Worker{
+			{Id: "1", LastSeen: time.Now(), Labels: gpu},
+			{Id: "2", LastSeen: time.Now(), Labels: map[string]string{"tenant": "a"}},
+		}},
+	})
+	taker.allLeases = make(map[string]*Lease)
+	taker.Take()
+	v = strategy.view
+	assert(t, len(v.LeaseCounts) == 2 && len(v.Workers) == 2, "expect the lease counts to include only the eligible workers")
+}
+
+func TestTakerOwnershipTracking(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour)
+	taker, _ := newTestTaker(nil, nil, map[string]*Lease{
+		"foo": &Lease{Key: "foo", Owner: "1", Counter: 1, acquiredAt: hourAgo},
+		"bar": &Lease{Key: "bar", Owner: "NULL", Counter: 1, acquiredAt: hourAgo},
+		"baz": &Lease{Key: "baz", Owner: "1", Counter: 1, acquiredAt: hourAgo},
+	})
+	now := time.Now()
+	taker.updateLeases([]*Lease{
+		// stolen by "2"
+		&Lease{Key: "foo", Owner: "2", Counter: 2, lastRenewal: now},
+		// taken by "2"
+		&Lease{Key: "bar", Owner: "2", Counter: 2, lastRenewal: now},
+		// renewed by "1"
+		&Lease{Key: "baz", Owner: "1", Counter: 2, lastRenewal: now},
+		// new lease
+		&Lease{Key: "qux", Owner: "1", Counter: 1, lastRenewal: now},
+	})
+	foo, bar, baz, qux := taker.allLeases["foo"], taker.allLeases["bar"], taker.allLeases["baz"], taker.allLeases["qux"]
+	assert(t, foo.acquiredAt == now && foo.stolenAt == now, "expect to track the steal")
+	assert(t, bar.acquiredAt == now && bar.stolenAt.IsZero(), "expect to track the take")
+	assert(t, baz.acquiredAt == hourAgo && baz.stolenAt.IsZero(), "expect to keep the ownership time")
+	assert(t, qux.acquiredAt == now, "expect new leases to be acquired at the time of the scan")
+}
+
+func TestTakerStealBudget(t *testing.T) {
+	for _, test := range []struct {
+		budget           interface{}
+		takes            args
+		expectedTakes    int
+		expectedReleased int
+	}{
+		{5, args{nil, nil, nil}, 3, 0},
+		{1, args{nil}, 1, 0},
+		{0, nil, 0, 0},
+		{errors.New("budget failed"), nil, 0, 0},
+		// the budget of the failed steals is released
+		{5, args{nil, errors.New("take failed"), errors.New("take failed")}, 3, 2},
+	} {
+		taker, manager := newTestTaker(map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: "foo", Owner: "1", lastRenewal: time.Now()},
+				&Lease{Key: "bar", Owner: "1", lastRenewal: time.Now()},
+				&Lease{Key: "baz", Owner: "1", lastRenewal: time.Now()},
+			}},
+			methodStealBudget: {test.budget},
+			methodTake:        test.takes,
+		}, &strategyMock{steal: []string{"foo", "bar", "baz"}}, nil)
+		taker.StealBudget = 10
+		taker.Take()
+		assert(t, manager.calls[methodStealBudget] == 1, "expect to acquire steal budget")
+		assert(t, manager.calls[methodTake] == test.expectedTakes,
+			fmt.Sprintf("budget %v: expect to steal %d leases, got %d", test.budget, test.expectedTakes, manager.calls[methodTake]))
+		assert(t, manager.released == test.expectedReleased,
+			fmt.Sprintf("budget %v: expect to release %d steals, got %d", test.budget, test.expectedReleased, manager.released))
+	}
+}
+
+func TestTakerParents(t *testing.T) {
+	newList := func(completed bool) []*Lease {
+		return []*Lease{
+			&Lease{Key: "parent", Owner: "1", Counter: 1, lastRenewal: time.Now(), Completed: completed},
+			&Lease{Key: "child", Owner: "NULL", Counter: 1, lastRenewal: time.Now(), Parents: []string{"parent", "deleted"}},
+			&Lease{Key: "orphan", Owner: "NULL", Counter: 1, lastRenewal: time.Now(), Parents: []string{"deleted"}},
+		}
+	}
+	strategy := &strategyMock{}
+	taker, _ := newTestTaker(map[method]args{
+		methodList: {newList(false), newList(true)},
+	}, strategy, nil)
+
+	taker.Take()
+	v := strategy.view
+	assert(t, v.Leases["child"] == nil, "expect to ignore leases with uncompleted parents")
+	assert(t, v.Leases["orphan"] != nil, "expect deleted parents to be regarded as completed")
+	assert(t, len(v.Expired) == 1, "expect only the orphan lease to be available")
+
+	// the parent was completed, and its counter didn't change.
+	taker.Take()
+	v = strategy.view
+	assert(t, v.Leases["child"] != nil, "expect the child to be eligible once its parents completed")
+	assert(t, len(v.Expired) == 2, "expect the child lease to be available")
+}
+
+func TestTakerCompleted(t *testing.T) {
+	strategy := &strategyMock{}
+	taker, manager := newTestTaker(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "done", Owner: "NULL", Counter: 1, lastRenewal: time.Now().Add(-time.Hour), Completed: true, CompletedAt: time.Now()},
+			&Lease{Key: "old", Owner: "NULL", Counter: 1, lastRenewal: time.Now(), Completed: true, CompletedAt: time.Now().Add(-time.Hour)},
+			&Lease{Key: "todo", Owner: "NULL", Counter: 1, lastRenewal: time.Now()},
+		}},
+		methodDelete: {nil},
+	}, strategy, map[string]*Lease{
+		"done": &Lease{Key: "done", Owner: "NULL", Counter: 1, lastRenewal: time.Now().Add(-time.Hour)},
+	})
+	taker.CompletedRetention = time.Minute
+
+	taker.Take()
+	v := strategy.view
+	assert(t, len(v.Leases) == 1 && v.Leases["todo"] != nil, "expect to ignore completed leases")
+	assert(t, manager.calls[methodEvict] == 0, "expect not to evict completed leases")
+	assert(t, manager.calls[methodDelete] == 1, "expect to delete the lease that was completed before the retention period")
+	assert(t, taker.allLeases["old"] == nil, "expect to forget the deleted lease")
+}
+
+func TestTakerNotBefore(t *testing.T) {
+	newList := func() []*Lease {
+		return []*Lease{
+			&Lease{Key: "now", Owner: "NULL", Counter: 1, lastRenewal: time.Now(), NotBefore: time.Now().Add(-time.Second)},
+			&Lease{Key: "later", Owner: "NULL", Counter: 1, lastRenewal: time.Now(), NotBefore: time.Now().Add(time.Hour)},
+		}
+	}
+	strategy := &strategyMock{}
+	taker, manager := newTestTaker(map[method]args{
+		methodList: {newList(), newList()},
+	}, strategy, nil)
+
+	taker.Take()
+	v := strategy.view
+	assert(t, v.Leases["now"] != nil, "expect leases whose time has come to be eligible")
+	assert(t, v.Leases["later"] == nil, "expect to ignore leases scheduled to a future time")
+	assert(t, len(v.Expired) == 1, "expect only the due lease to be available")
+
+	// the scheduled lease has no owner, and its counter did not change for long.
+	taker.allLeases["later"].lastRenewal = time.Now().Add(-time.Hour)
+	taker.Take()
+	assert(t, manager.calls[methodEvict] == 0, "expect not to evict leases without owner")
+}
+
+func TestTakerHandoff(t *testing.T) {
+	newList := func(pendingOwner string) []*Lease {
+		return []*Lease{
+			&Lease{Key: "foo", Owner: "2", Counter: 1, lastRenewal: time.Now(), PendingOwner: pendingOwner},
+			&Lease{Key: "bar", Owner: "2", Counter: 1, lastRenewal: time.Now()},
+		}
+	}
+	// the forced take succeeds, or fails.
+	for _, takeErr := range []error{nil, errors.New("take failed")} {
+		strategy := &strategyMock{steal: []string{"foo"}}
+		taker, manager := newTestTaker(map[method]args{
+			methodList:           {newList(""), newList(takerId), newList(takerId)},
+			methodStealBudget:    {1},
+			methodRequestHandoff: {nil},
+			methodTake:           {takeErr},
+		}, strategy, nil)
+		taker.HandoffTimeout = time.Minute
+		taker.StealBudget = 1
+
+		taker.Take()
+		assert(t, manager.calls[methodRequestHandoff] == 1, "expect to request handoff instead of stealing")
+		assert(t, manager.calls[methodTake] == 0, "expect not to steal the lease")
+		assert(t, manager.released == 0, "expect to keep the budget of the requested handoff")
+
+		// the lease is pending to be handed off to us.
+		strategy.steal = nil
+		taker.Take()
+		v := strategy.view
+		assert(t, v.LeaseCounts[takerId] == 1 && v.LeaseCounts["2"] == 1, "expect pending leases to be counted for their pending owner")
+		assert(t, !v.CanSteal(v.Leases["foo"]), "expect not to steal leases that are being handed off")
+		assert(t, manager.calls[methodTake] == 0, "expect not to take the lease before the handoff timeout")
+
+		// the owner did not hand off the lease within the timeout.
+		taker.handoffs["foo"] = time.Now().Add(-time.Hour)
+		taker.Take()
+		assert(t, manager.calls[methodTake] == 1, "expect to take the lease forcefully after the handoff timeout")
+		assert(t, len(taker.handoffs) == 0, "expect to forget the handoff request")
+		if takeErr != nil {
+			assert(t, manager.released == 1, "expect to release the budget of the failed take")
+		} else {
+			assert(t, manager.released == 0, "expect to keep the budget of the taken lease")
+		}
+	}
+}
+
+func TestTakerMaxHoldDuration(t *testing.T) {
+	strategy := &strategyMock{}
+	// the renewer releases the leases by eviction, that does not change the counter.
+	taker, _ := newTestTaker(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "foo", Owner: "NULL", PreviousOwner: takerId, Counter: 1, lastRenewal: time.Now()},
+			&Lease{Key: "bar", Owner: "NULL", PreviousOwner: "2", Counter: 1, lastRenewal: time.Now()},
+		}},
+		methodListWorkers: {[]Worker{{Id: "2", LastSeen: time.Now()}}},
+	}, strategy, map[string]*Lease{
+		"foo": &Lease{Key: "foo", Owner: takerId, Counter: 1, lastRenewal: time.Now()},
+		"bar": &Lease{Key: "bar", Owner: "2", Counter: 1, lastRenewal: time.Now()},
+	})
+	taker.MaxHoldDuration = time.Minute
+
+	taker.Take()
+	v := strategy.view
+	assert(t, v.Leases["foo"] == nil, "expect not to re-take the lease we just released")
+	assert(t, v.Leases["bar"] != nil, "expect to take leases released by other workers")
+	eligible := v.Eligible(v.Leases["bar"])
+	assert(t, len(eligible) == 1 && eligible[0] == takerId, "expect the releaser not to be eligible to take the lease")
+	take, _ := (&RendezvousStrategy{}).Choose(v)
+	assert(t, len(take) == 1 && take[0].Key == "bar", "expect the lease to rotate to another worker")
+}
+
+func TestTakerExpireAfter(t *testing.T) {
+	lastRenewal := time.Now().Add(-time.Minute)
+	strategy := &strategyMock{}
+	taker, manager := newTestTaker(map[method]args{
+		methodList: {[]*Lease{
+			&Lease{Key: "foo", Owner: "2", Counter: 1, lastRenewal: time.Now()},
+			&Lease{Key: "bar", Owner: "2", Counter: 1, lastRenewal: time.Now(), ExpireAfter: time.Hour},
+		}},
+		methodEvict: {nil},
+	}, strategy, map[string]*Lease{
+		"foo": &Lease{Key: "foo", Owner: "2", Counter: 1, lastRenewal: lastRenewal},
+		"bar": &Lease{Key: "bar", Owner: "2", Counter: 1, lastRenewal: lastRenewal},
+	})
+	taker.ExpireAfter = 10 * time.Second
+
+	taker.Take()
+	v := strategy.view
+	assert(t, manager.calls[methodEvict] == 1, "expect to evict only the lease with the default expiry")
+	assert(t, len(v.Expired) == 1 && v.Expired[0].Key == "foo", "expect the lease with longer expiry not to be expired")
+}
+
+func TestTakerWallClockExpiry(t *testing.T) {
+	for _, wallClock := range []bool{false, true} {
+		strategy := &strategyMock{}
+		taker, _ := newTestTaker(map[method]args{
+			methodList: {[]*Lease{
+				&Lease{Key: "dead", Owner: "2", Counter: 1, lastRenewal: time.Now(), RenewedAt: time.Now().Add(-time.Minute)},
+				&Lease{Key: "alive", Owner: "2", Counter: 1, lastRenewal: time.Now(), RenewedAt: time.Now()},
+			}},
+		}, strategy, nil)
+		taker.ExpireAfter, taker.WallClockExpiry, taker.MaxClockSkew = 10*time.Second, wallClock, time.Second
+
+		taker.Take()
+		v := strategy.view
+		if wallClock {
+			assert(t, len(v.Expired) == 1 && v.Expired[0].Key == "dead", "expect to judge the expiry by the renewal time")
+		} else {
+			assert(t, len(v.Expired) == 0, "expect to judge the expiry by our own observation")
+		}
+	}
+}